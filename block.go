@@ -1,14 +1,9 @@
-// +build cublas
-
 package goFeature
 
 import (
-	"context"
-	"errors"
+	"math"
+	"sort"
 	"sync"
-
-	"github.com/unixpickle/cuda"
-	"github.com/unixpickle/cuda/cublas"
 )
 
 type _Block struct {
@@ -17,9 +12,8 @@ type _Block struct {
 	BlockSize int
 	Buffer    Buffer
 	Mutex     sync.Mutex
-	Ctx       *cuda.Context
-	Handle    *cublas.Handle
-	Allocator cuda.Allocator
+	Device    Device
+	Kernel    Kernel
 
 	// feature info
 	Dims      int
@@ -29,51 +23,75 @@ type _Block struct {
 	Empty     []int
 	NextIndex int
 	IDs       []FeatureID
+	Slots     map[FeatureID]int
+	Norms     []float32
+	Attrs     []Attributes
 
 	// internal
-	jobCancle    context.CancelFunc
-	inputBuffer  Buffer
 	outputBuffer Buffer
 }
 
-func NewBlock(ctx *cuda.Context, allocator cuda.Allocator, index, blockSize int, buffer Buffer) Block {
+func NewBlock(device Device, index, blockSize int, buffer Buffer) Block {
 	block := &_Block{
 		Index:     index,
 		BlockSize: blockSize,
 		Buffer:    buffer,
-		Ctx:       ctx,
-		Allocator: allocator,
+		Device:    device,
 	}
 	return block
 }
 
-func (b *_Block) IsOwned() bool { return b.Owner != "" }
+func (b *_Block) IsOwned() bool { return b.GetOwner() != "" }
+
+// GetOwner : name of the set which accquired the block, empty if not owned
+func (b *_Block) GetOwner() string {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+	return b.Owner
+}
 
 func (b *_Block) Capacity() int { return b.BlockSize / (b.Precision * b.Dims) }
 
+// Size : number of live features in the block
+func (b *_Block) Size() int {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+	return len(b.Slots)
+}
+
+// Deleted : number of deleted slots not reused
+func (b *_Block) Deleted() int {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+	return len(b.Empty)
+}
+
 func (b *_Block) Margin() int {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
 	length := b.BlockSize / (b.Precision * b.Dims)
 	return len(b.Empty) + (length - b.NextIndex)
 }
 
-func (b *_Block) Accquire(handle *cublas.Handle, owner string, dims, precision, batch int, worker func(context.Context, Buffer, Buffer)) (err error) {
+func (b *_Block) Accquire(kernel Kernel, owner string, dims, precision, batch int) (err error) {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+
 	if b.Owner != "" {
 		return ErrBlockUsed
 	}
+	if b.outputBuffer, err = b.Device.NewBuffer(batch * (b.BlockSize / (dims * precision)) * precision); err != nil {
+		return err
+	}
 	b.Dims = dims
 	b.Precision = precision
+	b.Batch = batch
 	b.Owner = owner
-	b.Handle = handle
+	b.Kernel = kernel
 	b.IDs = make([]FeatureID, b.BlockSize/(precision*dims))
-	if b.inputBuffer, err = NewGPUBuffer(b.Ctx, b.Allocator, batch*dims*precision); err != nil {
-		return err
-	}
-	if b.outputBuffer, err = NewGPUBuffer(b.Ctx, b.Allocator, batch*(b.BlockSize/(dims*precision))*precision); err != nil {
-		return err
-	}
-	var ctx context.Context
-	ctx, b.jobCancle = context.WithCancel(context.Background())
-	go worker(ctx, b.inputBuffer, b.outputBuffer)
+	b.Slots = make(map[FeatureID]int, 0)
+	b.Norms = make([]float32, b.BlockSize/(precision*dims))
+	b.Attrs = make([]Attributes, b.BlockSize/(precision*dims))
 	return
 }
 
@@ -100,10 +118,13 @@ func (b *_Block) Insert(features ...Feature) (err error) {
 			if err != nil {
 				return err
 			}
-			if err = buffer.Write(FeatureValue(vector[i*b.Dims : (i+1)*b.Dims])); err != nil {
+			if err = buffer.Write(FeatureValue(vector[i*b.Dims*b.Precision : (i+1)*b.Dims*b.Precision])); err != nil {
 				return ErrWriteCudaBuffer
 			}
 			b.IDs[index] = features[i].ID
+			b.Slots[features[i].ID] = index
+			b.Norms[index] = squareNorm(features[i].Value)
+			b.Attrs[index] = features[i].Attributes
 		}
 	}
 
@@ -112,12 +133,15 @@ func (b *_Block) Insert(features ...Feature) (err error) {
 		if err != nil {
 			return err
 		}
-		if err = buffer.Write(FeatureValue(vector[len(b.Empty)*b.Dims:])); err != nil {
+		if err = buffer.Write(FeatureValue(vector[len(b.Empty)*b.Dims*b.Precision:])); err != nil {
 			return err
 		}
 
 		for i, feature := range features[len(b.Empty):] {
 			b.IDs[b.NextIndex+i] = feature.ID
+			b.Slots[feature.ID] = b.NextIndex + i
+			b.Norms[b.NextIndex+i] = squareNorm(feature.Value)
+			b.Attrs[b.NextIndex+i] = feature.Attributes
 		}
 	}
 
@@ -130,124 +154,289 @@ func (b *_Block) Insert(features ...Feature) (err error) {
 	return
 }
 
-// Delete :
-// 	delete N feature(s) from block
-func (b *_Block) Delete(ids ...FeatureID) (deleted []FeatureID, err error) {
-	targets := make(map[FeatureID]int, 0)
-	for _, id := range ids {
-		targets[id] = -1
+// Dump :
+//	copy the layout and features of the block
+func (b *_Block) Dump() (snapshot BlockSnapshot, err error) {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+
+	snapshot.NextIndex = b.NextIndex
+	snapshot.Empty = append([]int{}, b.Empty...)
+	snapshot.IDs = append([]FeatureID{}, b.IDs[:b.NextIndex]...)
+	snapshot.Attrs = append([]Attributes{}, b.Attrs[:b.NextIndex]...)
+	buffer, err := b.Buffer.Slice(0, b.NextIndex*b.Dims*b.Precision)
+	if err != nil {
+		return
 	}
-	for index, value := range b.IDs {
-		if _, exist := targets[value]; exist {
-			targets[value] = index
-		}
+	value, err := buffer.Read()
+	if err != nil {
+		return
 	}
-	if len(targets) == 0 {
+	snapshot.Value = make(FeatureValue, len(value))
+	copy(snapshot.Value, value)
+	return
+}
+
+// Load :
+//	load the layout and features into the block, the block should be accquired and empty
+func (b *_Block) Load(snapshot BlockSnapshot) (err error) {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+
+	if b.NextIndex != 0 || len(b.Empty) != 0 {
+		return ErrBlockUsed
+	}
+	if snapshot.NextIndex > len(b.IDs) {
+		return ErrBlockIsFull
+	}
+	size := b.Dims * b.Precision
+	if len(snapshot.IDs) != snapshot.NextIndex || len(snapshot.Attrs) != snapshot.NextIndex ||
+		len(snapshot.Value) != snapshot.NextIndex*size {
+		return ErrInvalidSnapshot
+	}
+	buffer, err := b.Buffer.Slice(0, len(snapshot.Value))
+	if err != nil {
 		return
 	}
+	if err = buffer.Write(snapshot.Value); err != nil {
+		return ErrWriteCudaBuffer
+	}
+	for index, id := range snapshot.IDs {
+		if id == "" {
+			continue
+		}
+		b.IDs[index] = id
+		b.Slots[id] = index
+		b.Norms[index] = squareNorm(snapshot.Value[index*size : (index+1)*size])
+		b.Attrs[index] = snapshot.Attrs[index]
+	}
+	b.Empty = append([]int{}, snapshot.Empty...)
+	b.NextIndex = snapshot.NextIndex
+	return
+}
+
+// Compact :
+//	move live features at the tail into deleted slots, and lower the next index
+func (b *_Block) Compact() (moved int, err error) {
 	b.Mutex.Lock()
 	defer b.Mutex.Unlock()
-	for id, index := range targets {
-		if index != -1 {
-			buffer, err := b.Buffer.Slice(index*b.Dims*b.Precision, (index+1)*b.Dims*b.Precision)
-			if err != nil {
-				return nil, err
-			}
-			if err = buffer.Reset(); err != nil {
-				return nil, ErrClearCudaBuffer
-			}
-			b.IDs[index] = ""
-			b.Empty = append(b.Empty, index)
-			deleted = append(deleted, id)
+
+	size := b.Dims * b.Precision
+	holes := append([]int{}, b.Empty...)
+	sort.Ints(holes)
+	for _, hole := range holes {
+		// drop deleted slots at the tail
+		for b.NextIndex > 0 && b.IDs[b.NextIndex-1] == "" {
+			b.NextIndex--
+		}
+		if hole >= b.NextIndex {
+			break
 		}
+		tail := b.NextIndex - 1
+		src, err := b.Buffer.Slice(tail*size, (tail+1)*size)
+		if err != nil {
+			return moved, err
+		}
+		dst, err := b.Buffer.Slice(hole*size, (hole+1)*size)
+		if err != nil {
+			return moved, err
+		}
+		if err = dst.Copy(src); err != nil {
+			return moved, err
+		}
+		if err = src.Reset(); err != nil {
+			return moved, ErrClearCudaBuffer
+		}
+		id := b.IDs[tail]
+		b.IDs[hole], b.Norms[hole], b.Attrs[hole] = id, b.Norms[tail], b.Attrs[tail]
+		b.IDs[tail], b.Norms[tail], b.Attrs[tail] = "", 0, nil
+		b.Slots[id] = hole
+		b.NextIndex--
+		moved++
+	}
+	for b.NextIndex > 0 && b.IDs[b.NextIndex-1] == "" {
+		b.NextIndex--
+	}
+	b.Empty = make([]int, 0)
+	return
+}
+
+// Delete :
+// 	delete N feature(s) from block
+func (b *_Block) Delete(ids ...FeatureID) (deleted []FeatureID, err error) {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+	for _, id := range ids {
+		index, exist := b.Slots[id]
+		if !exist {
+			continue
+		}
+		buffer, err := b.Buffer.Slice(index*b.Dims*b.Precision, (index+1)*b.Dims*b.Precision)
+		if err != nil {
+			return nil, err
+		}
+		if err = buffer.Reset(); err != nil {
+			return nil, ErrClearCudaBuffer
+		}
+		b.IDs[index] = ""
+		b.Norms[index] = 0
+		b.Attrs[index] = nil
+		delete(b.Slots, id)
+		b.Empty = append(b.Empty, index)
+		deleted = append(deleted, id)
 	}
 	return
 }
 
 // Update :
-// 	update N feature(s) in the block
+// 	update N feature(s) in the block, overwrite the vector in place
 func (b *_Block) Update(features ...Feature) (updated []FeatureID, err error) {
-	// TODO
+	for _, feature := range features {
+		if len(feature.Value) != b.Dims*b.Precision {
+			return nil, ErrMismatchDimension
+		}
+	}
+
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+	for _, feature := range features {
+		index, exist := b.Slots[feature.ID]
+		if !exist {
+			continue
+		}
+		buffer, err := b.Buffer.Slice(index*b.Dims*b.Precision, (index+1)*b.Dims*b.Precision)
+		if err != nil {
+			return nil, err
+		}
+		if err = buffer.Write(feature.Value); err != nil {
+			return nil, ErrWriteCudaBuffer
+		}
+		b.Norms[index] = squareNorm(feature.Value)
+		if feature.Attributes != nil {
+			b.Attrs[index] = feature.Attributes
+		}
+		updated = append(updated, feature.ID)
+	}
 	return
 }
 
 // Read :
 //  get features detail info from block
+//  features are returned in the order of ids, missing ones are skipped
 func (b *_Block) Read(ids ...FeatureID) (features []Feature, err error) {
-	// TODO
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+	for _, id := range ids {
+		index, exist := b.Slots[id]
+		if !exist {
+			continue
+		}
+		buffer, err := b.Buffer.Slice(index*b.Dims*b.Precision, (index+1)*b.Dims*b.Precision)
+		if err != nil {
+			return nil, err
+		}
+		value, err := buffer.Read()
+		if err != nil {
+			return nil, err
+		}
+		feature := Feature{ID: id, Value: make(FeatureValue, len(value)), Attributes: b.Attrs[index]}
+		copy(feature.Value, value)
+		features = append(features, feature)
+	}
 	return
 }
 
 // Search :
-//	search N features(s) in the block
-//	empty block will return score=0 result
-func (b *_Block) Search(inputBuffer, outputBuffer Buffer, batch, limit int) (ret [][]FeatureSearchResult, err error) {
-	dimension := b.Dims
+//	search N features(s) in the block, products are stored in the output buffer of the block
+//	empty slots and slots filtered out by options are excluded
+func (b *_Block) Search(inputBuffer Buffer, batch int, opts SearchOptions) (ret [][]FeatureSearchResult, err error) {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+
+	if batch > b.Batch {
+		return nil, ErrOutOfBatch
+	}
 	height := b.NextIndex
 	if height == 0 {
 		return
 	}
 
-	vec3 := make([]float32, height*batch)
-	err = <-b.Ctx.Run(func() (e error) {
-		var alpha, beta float32
-		alpha = 1.0
-		beta = 0.0
-		e = b.Handle.Sgemm(
-			cublas.NoTrans,
-			cublas.NoTrans,
-			batch,
-			height,
-			dimension,
-			&alpha,
-			inputBuffer.GetBuffer().(cuda.Buffer),
-			batch,
-			b.Buffer.GetBuffer().(cuda.Buffer),
-			dimension,
-			&beta,
-			outputBuffer.GetBuffer().(cuda.Buffer),
-			batch,
-		)
-		if e != nil {
-			return
-		}
-		e = cuda.ReadBuffer(vec3, outputBuffer.GetBuffer().(cuda.Buffer))
-		if e != nil {
-			return errors.New("fail to read buffer vec3, err:" + e.Error())
-		}
-		for i := 0; i < batch; i++ {
-			slc, err := outputBuffer.Slice(i*height*b.Precision, (i+1)*height*b.Precision)
-			if slc == nil || err != nil {
-				e = ErrSliceBuffer
-				return
-			}
-		}
-		return nil
-	})
+	matrix, err := b.Buffer.Slice(0, height*b.Dims*b.Precision)
+	if err != nil {
+		return
+	}
+	if err = b.Kernel.MatMul(inputBuffer, matrix, b.outputBuffer, batch, height, b.Dims); err != nil {
+		return
+	}
+	limit := opts.Limit
+	if opts.unlimited {
+		limit = height
+	}
+	transform := b.transform(batch, height, opts)
+	topIndexes, topScores, err := b.Kernel.SelectTopK(b.outputBuffer, batch, height, limit, float32(opts.Threshold), transform)
 	if err != nil {
 		return
 	}
-	//  Trans result
 	for i := 0; i < batch; i++ {
-		var vec []float32
-		for j := 0; j < height; j++ {
-			vec = append(vec, vec3[j*batch+i])
-		}
 		var result []FeatureSearchResult
-		indexes, scores := MaxNFloat32(vec, limit)
+		indexes, scores := topIndexes[i], topScores[i]
 		for j, index := range indexes {
-			if b.IDs[index] != "" {
-				r := FeatureSearchResult{Score: FeatureScore(scores[j]), ID: b.IDs[index]}
-				result = append(result, r)
+			if math.IsInf(float64(scores[j]), -1) {
+				break
 			}
+			r := FeatureSearchResult{Score: FeatureScore(scores[j]), ID: b.IDs[index], Attributes: b.Attrs[index]}
+			result = append(result, r)
 		}
-		//result.Index, result.Score = b.IDs[index], score
 		ret = append(ret, result)
 	}
 
 	return
 }
 
+// transform :
+//	convert inner product to the score of metric in opts, and set scores of empty slots and
+//	the ones filtered out to -Inf
+//	target features are normalized by set for cosine
+func (b *_Block) transform(batch, height int, opts SearchOptions) (transform ScoreTransform) {
+	transform.Scale = make([]float32, height)
+	transform.Bias = make([]float32, height)
+	if opts.Metric == MetricL2 {
+		transform.QueryBias = make([]float32, batch)
+		for i := 0; i < batch; i++ {
+			transform.QueryBias[i] = -opts.norms[i]
+		}
+	}
+
+	var allowed []bool
+	if len(opts.IDs) > 0 {
+		allowed = make([]bool, height)
+		for _, id := range opts.IDs {
+			if index, exist := b.Slots[id]; exist && index < height {
+				allowed[index] = true
+			}
+		}
+	}
+	masked := float32(math.Inf(-1))
+	for j := 0; j < height; j++ {
+		if b.IDs[j] == "" || (allowed != nil && !allowed[j]) ||
+			(opts.Filter != nil && !opts.Filter.Match(b.Attrs[j])) {
+			transform.Bias[j] = masked
+			continue
+		}
+		switch opts.Metric {
+		case MetricCosine:
+			if norm := float32(math.Sqrt(float64(b.Norms[j]))); norm != 0 {
+				transform.Scale[j] = 1 / norm
+			}
+		case MetricL2:
+			transform.Scale[j], transform.Bias[j] = 2, -b.Norms[j]
+		default:
+			transform.Scale[j] = 1
+		}
+	}
+	return
+}
+
 // Release :
 // 	release the whole block and clear the memory
 func (b *_Block) Release() (err error) {
@@ -258,13 +447,28 @@ func (b *_Block) Release() (err error) {
 		return ErrClearCudaBuffer
 	}
 
-	b.jobCancle()
 	b.Dims = 0
 	b.Precision = 0
+	b.Batch = 0
 	b.Owner = ""
+	b.Kernel = nil
+	b.outputBuffer = nil
 	b.IDs = make([]FeatureID, 0)
+	b.Slots = make(map[FeatureID]int, 0)
+	b.Norms = make([]float32, 0)
+	b.Attrs = make([]Attributes, 0)
 	b.Empty = make([]int, 0)
 	b.NextIndex = 0
 
 	return
 }
+
+// squareNorm :
+//	squared norm of float32 feature value, 0 if invalid
+func squareNorm(value FeatureValue) float32 {
+	feature, err := TFloat32Value(value)
+	if err != nil {
+		return 0
+	}
+	return SquareNormFloat32(feature)
+}
@@ -1,48 +1,62 @@
-// +build cublas
-
 package goFeature
 
 import (
+	"sort"
 	"sync"
-
-	"github.com/unixpickle/cuda"
-	"github.com/unixpickle/cuda/cublas"
+	"time"
 )
 
 type _Cache struct {
-	Ctx       *cuda.Context
+	Device    Device
 	AllBlocks []Block
-	Allocator cuda.Allocator
 	BlockSize int
 	Mutex     sync.Mutex
 	Sets      map[string]Set
+	Quotas    map[string]SetQuota
+	WAL       *WAL
+	// serialize SetWAL
+	WALMutex sync.Mutex
 }
 
-func NewCache(ctx *cuda.Context, blockNum, blockSize int) (cache *_Cache, err error) {
+// idle input buffers kept by each set
+const inputBufferNum = 4
+
+func NewCache(device Device, blockNum, blockSize int) (cache *_Cache, err error) {
 	cache = &_Cache{
-		Ctx:       ctx,
+		Device:    device,
 		BlockSize: blockSize,
 		Sets:      make(map[string]Set, 0),
-		Allocator: cuda.GCAllocator(cuda.NativeAllocator(ctx), 0),
+		Quotas:    make(map[string]SetQuota, 0),
 	}
 	var buffer Buffer
-	buffer, err = NewGPUBuffer(ctx, cache.Allocator, blockNum*blockSize)
+	buffer, err = device.NewBuffer(blockNum * blockSize)
 	if err != nil {
 		return
 	}
 	for i := 0; i < blockNum; i++ {
 		slc, e := buffer.Slice(i*blockSize, (i+1)*blockSize)
 		if e != nil || slc == nil {
-			err = ErrSliceGPUBuffer
+			err = ErrSliceBuffer
 			return
 		}
-		block := NewBlock(ctx, cache.Allocator, i, blockSize, slc)
+		block := NewBlock(device, i, blockSize, slc)
 		cache.AllBlocks = append(cache.AllBlocks, block)
 	}
 	return
 }
 
-func (c *_Cache) NewSet(name string, dims, precision, batch int) (err error) {
+func (c *_Cache) NewSet(name string, dims, precision, batch int, metric Metric, quota SetQuota) (err error) {
+	switch metric {
+	case MetricDefault:
+		metric = MetricInnerProduct
+	case MetricInnerProduct, MetricCosine, MetricL2:
+	default:
+		return ErrInvalidMetric
+	}
+	if quota.MinBlocks < 0 || quota.MaxBlocks < 0 || (quota.MaxBlocks > 0 && quota.MinBlocks > quota.MaxBlocks) {
+		return ErrInvalidQuota
+	}
+
 	c.Mutex.Lock()
 	if _, exist := c.Sets[name]; exist {
 		c.Mutex.Unlock()
@@ -51,26 +65,51 @@ func (c *_Cache) NewSet(name string, dims, precision, batch int) (err error) {
 	c.Mutex.Unlock()
 
 	set := &FeatureSet{
-		Context:         c.Ctx,
 		Dimension:       dims,
 		Precision:       precision,
 		BlockFeatureNum: c.BlockSize / (dims * precision),
 		Name:            name,
 		Batch:           batch,
+		Metric:          metric,
+		Quota:           quota,
+		Created:         time.Now(),
+		Index:           make(map[FeatureID]Block, 0),
 		Cache:           c,
-		SearchQueue:     make(chan SearchJob, 10),
+		Device:          c.Device,
+		inputBuffers:    make(chan Buffer, inputBufferNum),
 	}
 
-	if set.Handle, err = cublas.NewHandle(c.Ctx); err != nil {
+	if set.Kernel, err = c.Device.NewKernel(); err != nil {
 		return
 	}
 
 	c.Mutex.Lock()
 	defer c.Mutex.Unlock()
+	// another set of the same name may be created while the kernel is created
+	if _, exist := c.Sets[name]; exist {
+		return ErrFeatureSetExist
+	}
+	if quota.MinBlocks > 0 {
+		owned := c.ownedBlocks()
+		if quota.MinBlocks > owned[""]-c.reservedBlocks(owned, "") {
+			return ErrNotEnoughBlocks
+		}
+	}
+	if c.WAL != nil {
+		if err = c.WAL.logNewSet(name, dims, precision, batch, metric, quota); err != nil {
+			return
+		}
+	}
+	// the set is not visible yet, SetWAL updates it once it is in c.Sets
+	set.WAL = c.WAL
 	c.Sets[name] = set
+	c.Quotas[name] = quota
 	return
 }
 
+// DestroySet :
+//	remove the set from cache once it is logged, then release its blocks
+//	the set is destroyed after c.Mutex is released, since sets lock c.Mutex while holding their own mutex
 func (c *_Cache) DestroySet(name string) (err error) {
 	c.Mutex.Lock()
 	set, exist := c.Sets[name]
@@ -78,15 +117,41 @@ func (c *_Cache) DestroySet(name string) (err error) {
 		c.Mutex.Unlock()
 		return ErrFeatureSetNotFound
 	}
+	if c.WAL != nil {
+		if err = c.WAL.logDestroySet(name); err != nil {
+			c.Mutex.Unlock()
+			return
+		}
+	}
+	delete(c.Sets, name)
+	delete(c.Quotas, name)
 	c.Mutex.Unlock()
 
-	if err = set.Destroy(); err != nil {
-		return
-	}
+	return set.Destroy()
+}
+
+// SetWAL :
+//	attach write-ahead log to the cache and all the sets, mutations are logged since then
+//	sets are updated after c.Mutex is released, since sets lock c.Mutex while holding their own mutex
+func (c *_Cache) SetWAL(wal *WAL) {
+	c.WALMutex.Lock()
+	defer c.WALMutex.Unlock()
+
 	c.Mutex.Lock()
-	defer c.Mutex.Unlock()
-	delete(c.Sets, name)
-	return
+	c.WAL = wal
+	sets := make([]Set, 0, len(c.Sets))
+	for _, set := range c.Sets {
+		sets = append(sets, set)
+	}
+	c.Mutex.Unlock()
+
+	for _, set := range sets {
+		if fs, ok := set.(*FeatureSet); ok {
+			fs.Mutex.Lock()
+			fs.WAL = wal
+			fs.Mutex.Unlock()
+		}
+	}
 }
 
 func (c *_Cache) GetSet(name string) (set Set, err error) {
@@ -99,9 +164,120 @@ func (c *_Cache) GetSet(name string) (set Set, err error) {
 	return
 }
 
+// ListSets :
+//	names of all the sets, in sorted order
+func (c *_Cache) ListSets() (names []string) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	for name := range c.Sets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
 func (c *_Cache) GetBlockSize() int { return c.BlockSize }
 
+// Stats :
+//	usage statistics of the cache and all the sets
+//	sets are collected after c.Mutex is released, since sets lock c.Mutex while holding their own mutex
+func (c *_Cache) Stats() (stats CacheStats) {
+	c.Mutex.Lock()
+	sets := make([]Set, 0, len(c.Sets))
+	for _, set := range c.Sets {
+		sets = append(sets, set)
+	}
+	stats.Sets = len(c.Sets)
+	stats.TotalBlocks = len(c.AllBlocks)
+	for _, block := range c.AllBlocks {
+		if block.IsOwned() {
+			stats.UsedBlocks++
+		}
+	}
+	c.Mutex.Unlock()
+
+	stats.FreeBlocks = stats.TotalBlocks - stats.UsedBlocks
+	for _, set := range sets {
+		s := set.Stats()
+		stats.Features += s.Features
+		stats.Deleted += s.Deleted
+		stats.VectorBytes += s.VectorBytes
+		stats.ScratchBytes += s.ScratchBytes
+		stats.QueueDepth += s.QueueDepth
+	}
+	return
+}
+
 func (c *_Cache) GetEmptyBlock(blockNum int) ([]Block, error) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	return c.getEmptyBlock(blockNum)
+}
+
+// AccquireBlocks :
+//	find empty blocks and accquire them atomically under the cache mutex
+//	blocks reserved for other sets are kept, and the max blocks of owner is honoured
+//	blocks accquired are released if any of them fails
+func (c *_Cache) AccquireBlocks(owner string, blockNum int, accquire func(block Block) error) (blocks []Block, err error) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+
+	owned := c.ownedBlocks()
+	if quota := c.Quotas[owner]; quota.MaxBlocks > 0 && owned[owner]+blockNum > quota.MaxBlocks {
+		return nil, ErrQuotaExceeded
+	}
+	if blockNum > owned[""]-c.reservedBlocks(owned, owner) {
+		return nil, ErrNotEnoughBlocks
+	}
+
+	var emptyBlocks []Block
+	if emptyBlocks, err = c.getEmptyBlock(blockNum); err != nil {
+		return
+	}
+	for _, block := range emptyBlocks {
+		if err = accquire(block); err != nil {
+			for _, b := range blocks {
+				b.Release()
+			}
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	return
+}
+
+// GetBlockOwners :
+//	owner of each block in cache, empty if not owned
+func (c *_Cache) GetBlockOwners() []string {
+	owners := make([]string, len(c.AllBlocks))
+	for i, block := range c.AllBlocks {
+		owners[i] = block.GetOwner()
+	}
+	return owners
+}
+
+// ownedBlocks :
+//	number of blocks accquired by each set, "" for blocks not accquired, c.Mutex should be held
+func (c *_Cache) ownedBlocks() map[string]int {
+	owned := make(map[string]int, len(c.Sets)+1)
+	for _, block := range c.AllBlocks {
+		owned[block.GetOwner()]++
+	}
+	return owned
+}
+
+// reservedBlocks :
+//	number of empty blocks still reserved for the sets except the given one, c.Mutex should be held
+func (c *_Cache) reservedBlocks(owned map[string]int, except string) (reserved int) {
+	for name, quota := range c.Quotas {
+		if name != except && quota.MinBlocks > owned[name] {
+			reserved += quota.MinBlocks - owned[name]
+		}
+	}
+	return
+}
+
+func (c *_Cache) getEmptyBlock(blockNum int) ([]Block, error) {
 	var emptyBlocks []Block
 	for _, block := range c.AllBlocks {
 		if !block.IsOwned() {
@@ -0,0 +1,330 @@
+package goFeature
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentAccquire(t *testing.T) {
+	const (
+		dims      = 8
+		blockSize = 16 * dims * 4
+		sets      = 4
+	)
+	c, err := NewCache(newTestDevice(), 12, blockSize)
+	if err != nil {
+		t.Fatal("Fail to init cache, due to:", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < sets; i++ {
+		name := fmt.Sprintf("accquire_%d", i)
+		if err = c.NewSet(name, dims, 4, 2, MetricDefault, SetQuota{}); err != nil {
+			t.Fatal("Fail to init feature set, due to:", err)
+		}
+		s, err := c.GetSet(name)
+		if err != nil {
+			t.Fatal("Fail to get feature set, due to:", err)
+		}
+		wg.Add(1)
+		go func(s Set, seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for j := 0; j < 3; j++ {
+				if err := s.Add(randomFeatures(r, 16, dims)...); err != nil {
+					t.Error("Fail to add features, due to:", err)
+					return
+				}
+			}
+		}(s, int64(i))
+	}
+	wg.Wait()
+
+	owners := c.GetBlockOwners()
+	for i := 0; i < sets; i++ {
+		name := fmt.Sprintf("accquire_%d", i)
+		s, err := c.GetSet(name)
+		if err != nil {
+			t.Fatal("Fail to get feature set, due to:", err)
+		}
+		fs := s.(*FeatureSet)
+		if len(fs.Blocks) != 3 {
+			t.Fatal("Set", name, "should own 3 blocks, got:", len(fs.Blocks))
+		}
+		for _, block := range fs.Blocks {
+			if owner := owners[block.(*_Block).Index]; owner != name {
+				t.Fatal("Block", block.(*_Block).Index, "owned by", owner, "but used by", name)
+			}
+		}
+	}
+
+	// all or nothing
+	if _, err := c.AccquireBlocks("", 1, func(Block) error { return nil }); err != ErrNotEnoughBlocks {
+		t.Fatal("Cache should be full, err:", err)
+	}
+	s, err := c.GetSet("accquire_0")
+	if err != nil {
+		t.Fatal("Fail to get feature set, due to:", err)
+	}
+	kernel := s.(*FeatureSet).Kernel
+	if err := c.DestroySet("accquire_0"); err != nil {
+		t.Fatal("Fail to destroy set, due to:", err)
+	}
+	calls := 0
+	if _, err := c.AccquireBlocks("", 2, func(block Block) error {
+		if calls++; calls == 2 {
+			return ErrBlockUsed
+		}
+		return block.Accquire(kernel, "partial", dims, 4, 2)
+	}); err != ErrBlockUsed {
+		t.Fatal("Accquire should fail, err:", err)
+	}
+	if blocks, err := c.GetEmptyBlock(3); err != nil || len(blocks) != 3 {
+		t.Fatal("Partially accquired blocks should be released, err:", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	const (
+		dims      = 8
+		blockSize = 16 * dims * 4
+	)
+	c, err := NewCache(newTestDevice(), 4, blockSize)
+	if err != nil {
+		t.Fatal("Fail to init cache, due to:", err)
+	}
+	if err = c.NewSet("stats", dims, 4, 2, MetricDefault, SetQuota{}); err != nil {
+		t.Fatal("Fail to init feature set, due to:", err)
+	}
+	s, err := c.GetSet("stats")
+	if err != nil {
+		t.Fatal("Fail to get feature set, due to:", err)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	features := randomFeatures(r, 20, dims)
+	if err := s.Add(features...); err != nil {
+		t.Fatal("Fail to fill feature set, due to:", err)
+	}
+	if _, err := s.Delete(features[0].ID, features[1].ID); err != nil {
+		t.Fatal("Fail to delete features, due to:", err)
+	}
+
+	stats := s.Stats()
+	if stats.Blocks != 2 || stats.Capacity != 32 || stats.Features != 18 || stats.Deleted != 2 || stats.Free != 14 {
+		t.Fatal("Wrong set stats:", stats)
+	}
+	if stats.VectorBytes != 18*dims*4 || stats.ScratchBytes != 2*2*16*4 || stats.Fragmentation != 0.1 {
+		t.Fatal("Wrong set stats:", stats)
+	}
+
+	cacheStats := c.Stats()
+	if cacheStats.Sets != 1 || cacheStats.TotalBlocks != 4 || cacheStats.UsedBlocks != 2 || cacheStats.FreeBlocks != 2 {
+		t.Fatal("Wrong cache stats:", cacheStats)
+	}
+	if cacheStats.Features != 18 || cacheStats.Deleted != 2 || cacheStats.VectorBytes != stats.VectorBytes || cacheStats.ScratchBytes != stats.ScratchBytes {
+		t.Fatal("Wrong cache stats:", cacheStats)
+	}
+}
+
+func TestListSets(t *testing.T) {
+	c, err := NewCache(newTestDevice(), 4, 16*8*4)
+	if err != nil {
+		t.Fatal("Fail to init cache, due to:", err)
+	}
+	before := time.Now()
+	for _, name := range []string{"list_b", "list_a"} {
+		if err = c.NewSet(name, 8, 4, 2, MetricCosine, SetQuota{}); err != nil {
+			t.Fatal("Fail to init feature set, due to:", err)
+		}
+	}
+	if names := c.ListSets(); len(names) != 2 || names[0] != "list_a" || names[1] != "list_b" {
+		t.Fatal("Wrong set names:", names)
+	}
+
+	s, err := c.GetSet("list_a")
+	if err != nil {
+		t.Fatal("Fail to get feature set, due to:", err)
+	}
+	if err := s.Add(randomFeatures(rand.New(rand.NewSource(1)), 3, 8)...); err != nil {
+		t.Fatal("Fail to fill feature set, due to:", err)
+	}
+	info := s.Info()
+	if info.Name != "list_a" || info.Dims != 8 || info.Precision != 4 || info.Batch != 2 || info.Metric != MetricCosine {
+		t.Fatal("Wrong set info:", info)
+	}
+	if info.Features != 3 || info.Blocks != 1 || info.Created.Before(before) {
+		t.Fatal("Wrong set info:", info)
+	}
+
+	if err := c.DestroySet("list_b"); err != nil {
+		t.Fatal("Fail to destroy set, due to:", err)
+	}
+	if names := c.ListSets(); len(names) != 1 || names[0] != "list_a" {
+		t.Fatal("Wrong set names:", names)
+	}
+}
+
+func TestSetQuota(t *testing.T) {
+	const (
+		dims      = 8
+		blockSize = 16 * dims * 4
+	)
+	c, err := NewCache(newTestDevice(), 4, blockSize)
+	if err != nil {
+		t.Fatal("Fail to init cache, due to:", err)
+	}
+	if err = c.NewSet("quota_invalid", dims, 4, 2, MetricDefault, SetQuota{MinBlocks: 3, MaxBlocks: 2}); err != ErrInvalidQuota {
+		t.Fatal("NewSet should fail with invalid quota, err:", err)
+	}
+	for name, quota := range map[string]SetQuota{
+		"quota_max":      {MaxBlocks: 2},
+		"quota_reserved": {MinBlocks: 2},
+		"quota_none":     {},
+	} {
+		if err = c.NewSet(name, dims, 4, 2, MetricDefault, quota); err != nil {
+			t.Fatal("Fail to init feature set, due to:", err)
+		}
+	}
+	max, err := c.GetSet("quota_max")
+	if err != nil {
+		t.Fatal("Fail to get feature set, due to:", err)
+	}
+	reserved, err := c.GetSet("quota_reserved")
+	if err != nil {
+		t.Fatal("Fail to get feature set, due to:", err)
+	}
+	none, err := c.GetSet("quota_none")
+	if err != nil {
+		t.Fatal("Fail to get feature set, due to:", err)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	if err := max.Add(randomFeatures(r, 32, dims)...); err != nil {
+		t.Fatal("Fail to fill feature set, due to:", err)
+	}
+	if err := max.Add(randomFeatures(r, 1, dims)...); err != ErrQuotaExceeded {
+		t.Fatal("Add should fail with quota exceeded, err:", err)
+	}
+	// the rest blocks are reserved
+	if err := none.Add(randomFeatures(r, 1, dims)...); err != ErrNotEnoughBlocks {
+		t.Fatal("Add should not take reserved blocks, err:", err)
+	}
+	if err = c.NewSet("quota_more", dims, 4, 2, MetricDefault, SetQuota{MinBlocks: 1}); err != ErrNotEnoughBlocks {
+		t.Fatal("NewSet should fail to reserve blocks, err:", err)
+	}
+	if err := reserved.Add(randomFeatures(r, 17, dims)...); err != nil {
+		t.Fatal("Fail to fill reserved set, due to:", err)
+	}
+	if stats := c.Stats(); stats.UsedBlocks != 4 {
+		t.Fatal("Wrong cache stats:", stats)
+	}
+
+	// quota is restored from snapshot
+	var buf bytes.Buffer
+	if err := reserved.Snapshot(&buf); err != nil {
+		t.Fatal("Fail to snapshot set, due to:", err)
+	}
+	if err := c.DestroySet("quota_reserved"); err != nil {
+		t.Fatal("Fail to destroy set, due to:", err)
+	}
+	if _, err := c.RestoreSet(&buf); err != nil {
+		t.Fatal("Fail to restore set, due to:", err)
+	}
+	reserved, _ = c.GetSet("quota_reserved")
+	if info := reserved.Info(); info.Quota != (SetQuota{MinBlocks: 2}) || info.Features != 17 {
+		t.Fatal("Wrong set info after restore:", info)
+	}
+}
+
+func TestConcurrentStats(t *testing.T) {
+	const dims = 8
+	c, err := NewCache(newTestDevice(), 4, 16*dims*4)
+	if err != nil {
+		t.Fatal("Fail to init cache, due to:", err)
+	}
+	if err = c.NewSet("concurrent_stats", dims, 4, 2, MetricDefault, SetQuota{}); err != nil {
+		t.Fatal("Fail to init feature set, due to:", err)
+	}
+	s, err := c.GetSet("concurrent_stats")
+	if err != nil {
+		t.Fatal("Fail to get feature set, due to:", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 200; i++ {
+			features := randomFeatures(r, 8, dims)
+			if err := s.Add(features...); err != nil {
+				t.Error("Fail to add features, due to:", err)
+				return
+			}
+			if _, err := s.Delete(features[0].ID, features[1].ID, features[2].ID, features[3].ID,
+				features[4].ID, features[5].ID, features[6].ID, features[7].ID); err != nil {
+				t.Error("Fail to delete features, due to:", err)
+				return
+			}
+			s.Compact()
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				c.Stats()
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Add and Stats are deadlocked")
+	}
+}
+
+func TestConcurrentNewSet(t *testing.T) {
+	const (
+		dims    = 8
+		workers = 8
+	)
+	c, err := NewCache(newTestDevice(), 4, 16*dims*4)
+	if err != nil {
+		t.Fatal("Fail to init cache, due to:", err)
+	}
+
+	// only one of the sets of the same name is created
+	for round := 0; round < 20; round++ {
+		name := fmt.Sprintf("concurrent_new_%d", round)
+		errs := make(chan error, workers)
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- c.NewSet(name, dims, 4, 2, MetricDefault, SetQuota{})
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		var created int
+		for err := range errs {
+			switch err {
+			case nil:
+				created++
+			case ErrFeatureSetExist:
+			default:
+				t.Fatal("Fail to init feature set, due to:", err)
+			}
+		}
+		if created != 1 {
+			t.Fatalf("Set %s should be created once, got %d", name, created)
+		}
+	}
+}
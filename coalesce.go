@@ -0,0 +1,201 @@
+package goFeature
+
+import (
+	"context"
+	"time"
+)
+
+// coalesceRequest : single-query search waiting to be merged into a batch
+type coalesceRequest struct {
+	Ctx     context.Context
+	Options SearchOptions
+	Feature FeatureValue
+	RetChan chan struct {
+		Result []FeatureSearchResult
+		Err    error
+	}
+}
+
+// coalescer : queue of requests and the worker merging them
+type coalescer struct {
+	Policy CoalescePolicy
+	Queue  chan coalesceRequest
+	// closed to stop the worker
+	Stop chan struct{}
+	// closed after the worker exits, requests not searched by then are never searched
+	Done chan struct{}
+}
+
+// SetCoalescePolicy :
+//	merge concurrent single-query searches into one batch, searches are not merged if policy.Window is zero
+func (s *FeatureSet) SetCoalescePolicy(policy CoalescePolicy) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if s.coalescer != nil {
+		close(s.coalescer.Stop)
+		s.coalescer = nil
+	}
+	if policy.Window <= 0 {
+		return
+	}
+	if policy.MaxBatch <= 0 || policy.MaxBatch > s.Batch {
+		policy.MaxBatch = s.Batch
+	}
+	s.coalescer = &coalescer{
+		Policy: policy,
+		Queue:  make(chan coalesceRequest, policy.MaxBatch),
+		Stop:   make(chan struct{}),
+		Done:   make(chan struct{}),
+	}
+	go s.doCoalesce(s.coalescer)
+}
+
+// doCoalesce :
+//	collect requests until the batch is full or the window expires, then search them together
+//	requests already queued are searched before the worker exits
+func (s *FeatureSet) doCoalesce(c *coalescer) {
+	defer close(c.Done)
+	for {
+		var requests []coalesceRequest
+		select {
+		case request := <-c.Queue:
+			requests = append(requests, request)
+		case <-c.Stop:
+			for {
+				select {
+				case request := <-c.Queue:
+					requests = append(requests, request)
+				default:
+					s.coalesceGroups(requests)
+					return
+				}
+			}
+		}
+
+		timer := time.NewTimer(c.Policy.Window)
+	collect:
+		for len(requests) < c.Policy.MaxBatch {
+			select {
+			case request := <-c.Queue:
+				requests = append(requests, request)
+			case <-timer.C:
+				break collect
+			case <-c.Stop:
+				break collect
+			}
+		}
+		timer.Stop()
+		s.coalesceGroups(requests)
+	}
+}
+
+// coalesceGroups :
+//	search the requests in batches of the same metric
+func (s *FeatureSet) coalesceGroups(requests []coalesceRequest) {
+	// scores of different metrics can not be computed in one batch
+	groups := make(map[Metric][]coalesceRequest, 1)
+	for _, request := range requests {
+		groups[request.Options.Metric] = append(groups[request.Options.Metric], request)
+	}
+	for _, group := range groups {
+		s.coalesceSearch(group)
+	}
+}
+
+// coalesceSearch :
+//	search the requests in one batch, and return the results to each caller
+//	the batch takes the max limit and min threshold, the threshold of each request is applied after search
+func (s *FeatureSet) coalesceSearch(requests []coalesceRequest) {
+	var (
+		features []FeatureValue
+		pending  []coalesceRequest
+		opts     SearchOptions
+	)
+	for _, request := range requests {
+		// skip the request if the caller has gone away
+		if err := request.Ctx.Err(); err != nil {
+			request.RetChan <- struct {
+				Result []FeatureSearchResult
+				Err    error
+			}{Err: err}
+			continue
+		}
+		if len(pending) == 0 {
+			opts = SearchOptions{Metric: request.Options.Metric, Threshold: request.Options.Threshold}
+		}
+		if request.Options.Limit > opts.Limit {
+			opts.Limit = request.Options.Limit
+		}
+		if request.Options.Threshold < opts.Threshold {
+			opts.Threshold = request.Options.Threshold
+		}
+		opts.norms = append(opts.norms, request.Options.norms...)
+		features = append(features, request.Feature)
+		pending = append(pending, request)
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	results, err := s.searchBlocks(context.Background(), len(pending), opts, features...)
+	for i, request := range pending {
+		var ret struct {
+			Result []FeatureSearchResult
+			Err    error
+		}
+		if ret.Err = err; err == nil {
+			for _, result := range results[i] {
+				if result.Score >= request.Options.Threshold {
+					ret.Result = append(ret.Result, result)
+				}
+			}
+		}
+		request.RetChan <- ret
+	}
+}
+
+// coalesce :
+//	search one feature in a coalesced batch, ok is false if searches are not merged
+func (s *FeatureSet) coalesce(ctx context.Context, opts SearchOptions, feature FeatureValue) (result []FeatureSearchResult, ok bool, err error) {
+	if len(opts.IDs) > 0 || opts.Filter != nil || opts.unlimited {
+		return nil, false, nil
+	}
+	s.Mutex.RLock()
+	c := s.coalescer
+	s.Mutex.RUnlock()
+	if c == nil {
+		return nil, false, nil
+	}
+
+	request := coalesceRequest{
+		Ctx:     ctx,
+		Options: opts,
+		Feature: feature,
+		RetChan: make(chan struct {
+			Result []FeatureSearchResult
+			Err    error
+		}, 1),
+	}
+	select {
+	case c.Queue <- request:
+	case <-c.Done:
+		return nil, false, nil
+	case <-ctx.Done():
+		return nil, true, ctx.Err()
+	}
+	select {
+	case ret := <-request.RetChan:
+		return ret.Result, true, ret.Err
+	case <-c.Done:
+		// the worker has exited, the request may be searched just before
+		select {
+		case ret := <-request.RetChan:
+			return ret.Result, true, ret.Err
+		default:
+			return nil, false, nil
+		}
+	case <-ctx.Done():
+		return nil, true, ctx.Err()
+	}
+}
@@ -0,0 +1,117 @@
+package goFeature
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingKernel : kernel counts matrix multiplications
+type countingKernel struct {
+	Kernel
+	calls int64
+}
+
+func (k *countingKernel) MatMul(input, matrix, output Buffer, batch, height, dims int) error {
+	atomic.AddInt64(&k.calls, 1)
+	return k.Kernel.MatMul(input, matrix, output, batch, height, dims)
+}
+
+func TestCoalesceSearch(t *testing.T) {
+	const (
+		dims      = 8
+		blockSize = 16 * dims * 4
+		batch     = 8
+	)
+	c, err := NewCache(newTestDevice(), 4, blockSize)
+	if err != nil {
+		t.Fatal("Fail to init cache, due to:", err)
+	}
+	if err = c.NewSet("coalesce", dims, 4, batch, MetricDefault, SetQuota{}); err != nil {
+		t.Fatal("Fail to init feature set, due to:", err)
+	}
+	s, err := c.GetSet("coalesce")
+	if err != nil {
+		t.Fatal("Fail to get feature set, due to:", err)
+	}
+	kernel := &countingKernel{Kernel: s.(*FeatureSet).Kernel}
+	s.(*FeatureSet).Kernel = kernel
+
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	features := randomFeatures(r, 16, dims)
+	if err := s.Add(features...); err != nil {
+		t.Fatal("Fail to fill feature set, due to:", err)
+	}
+	s.SetCoalescePolicy(CoalescePolicy{Window: time.Second})
+
+	// each caller keeps its own limit and threshold
+	var wg sync.WaitGroup
+	for i := 0; i < batch; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			opts := SearchOptions{Threshold: 0.99, Limit: 1}
+			if i%2 == 1 {
+				opts = SearchOptions{Threshold: -1, Limit: 3}
+			}
+			ret, err := s.SearchWithOptions(context.Background(), opts, features[i].Value)
+			if err != nil || len(ret[0]) != opts.Limit || ret[0][0].ID != features[i].ID {
+				t.Error("Fail to search coalesced feature, ret:", ret, "err:", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if calls := atomic.LoadInt64(&kernel.calls); calls != 1 {
+		t.Fatal("Searches should be merged into one batch, matmul calls:", calls)
+	}
+
+	// searches with filter are not merged
+	ret, err := s.SearchWithOptions(context.Background(), SearchOptions{Threshold: 0.99, Limit: 1, IDs: []FeatureID{features[2].ID}}, features[2].Value)
+	if err != nil || len(ret[0]) != 1 || ret[0][0].ID != features[2].ID {
+		t.Fatal("Fail to search with ids, ret:", ret, "err:", err)
+	}
+
+	// caller gone away before the window expires
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = s.SearchContext(ctx, 0.99, 1, features[0].Value); err != context.DeadlineExceeded {
+		t.Fatal("Search should be timeout, err:", err)
+	}
+
+	// searches are not merged after policy is reset
+	s.SetCoalescePolicy(CoalescePolicy{})
+	ret, err = s.Search(0.99, 1, features[3].Value)
+	if err != nil || len(ret[0]) != 1 || ret[0][0].ID != features[3].ID {
+		t.Fatal("Fail to search feature, ret:", ret, "err:", err)
+	}
+}
+
+func benchmarkSearchParallel(b *testing.B, policy CoalescePolicy) {
+	set.SetCoalescePolicy(policy)
+	defer set.SetCoalescePolicy(CoalescePolicy{})
+
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	var row []float32
+	for j := 0; j < dims; j++ {
+		row = append(row, r.Float32()*2-1)
+	}
+	target, _ := TFeatureValue(row)
+	b.SetParallelism(batch / 4)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := set.Search(0.0, 1, target); err != nil {
+				b.Fatalf("failed to search, err: %v", err)
+			}
+		}
+	})
+}
+
+func BenchmarkSearchParallel(b *testing.B) { benchmarkSearchParallel(b, CoalescePolicy{}) }
+
+func BenchmarkSearchCoalesced(b *testing.B) {
+	benchmarkSearchParallel(b, CoalescePolicy{Window: time.Millisecond})
+}
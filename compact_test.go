@@ -0,0 +1,151 @@
+package goFeature
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestCompact(t *testing.T) {
+	const (
+		dims      = 8
+		blockSize = 16 * dims * 4
+	)
+	c, err := NewCache(newTestDevice(), 4, blockSize)
+	if err != nil {
+		t.Fatal("Fail to init cache, due to:", err)
+	}
+	if err = c.NewSet("compact", dims, 4, 2, MetricDefault, SetQuota{}); err != nil {
+		t.Fatal("Fail to init feature set, due to:", err)
+	}
+	s, err := c.GetSet("compact")
+	if err != nil {
+		t.Fatal("Fail to get feature set, due to:", err)
+	}
+
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	features := randomFeatures(r, 40, dims)
+	if err := s.Add(features...); err != nil {
+		t.Fatal("Fail to fill feature set, due to:", err)
+	}
+	// keep 10 features spread over 3 blocks
+	var ids []FeatureID
+	for i, feature := range features {
+		if i%4 != 0 {
+			ids = append(ids, feature.ID)
+		}
+	}
+	if deleted, err := s.Delete(ids...); err != nil || len(deleted) != 30 {
+		t.Fatal("Fail to delete features, deleted:", deleted, "err:", err)
+	}
+
+	released, err := s.Compact()
+	if err != nil || released != 2 {
+		t.Fatal("Fail to compact set, released:", released, "err:", err)
+	}
+	fs := s.(*FeatureSet)
+	if len(fs.Blocks) != 1 || fs.Blocks[0].(*_Block).NextIndex != 10 || fs.Blocks[0].Deleted() != 0 {
+		t.Fatal("Fail to compact blocks, blocks:", len(fs.Blocks))
+	}
+	if blocks, err := c.GetEmptyBlock(3); err != nil || len(blocks) != 3 {
+		t.Fatal("Released blocks should be back to cache, err:", err)
+	}
+
+	for i := 0; i < len(features); i += 4 {
+		ret, err := s.Search(0.99, 1, features[i].Value)
+		if err != nil || len(ret[0]) != 1 || ret[0][0].ID != features[i].ID {
+			t.Fatal("Fail to search feature after compaction, ret:", ret, "err:", err)
+		}
+	}
+	if ret, err := s.Read(features[8].ID); err != nil || string(ret[0].Value) != string(features[8].Value) {
+		t.Fatal("Fail to read feature after compaction, err:", err)
+	}
+
+	// background compaction
+	if _, err = s.Delete(features[0].ID, features[4].ID); err != nil {
+		t.Fatal("Fail to delete features, due to:", err)
+	}
+	s.SetCompactPolicy(CompactPolicy{Interval: 10 * time.Millisecond, Fragmentation: 0.1})
+	defer s.SetCompactPolicy(CompactPolicy{})
+	for i := 0; i < 100 && fs.fragmentation() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fs.fragmentation() != 0 {
+		t.Fatal("Fail to compact set in background")
+	}
+}
+
+// failingBlock : block fails to insert, to break compaction halfway
+type failingBlock struct {
+	Block
+}
+
+func (b failingBlock) Insert(features ...Feature) error { return ErrWriteCudaBuffer }
+
+func TestCompactRollback(t *testing.T) {
+	const (
+		dims      = 8
+		blockSize = 16 * dims * 4
+	)
+	c, err := NewCache(newTestDevice(), 4, blockSize)
+	if err != nil {
+		t.Fatal("Fail to init cache, due to:", err)
+	}
+	if err = c.NewSet("compact_rollback", dims, 4, 2, MetricDefault, SetQuota{}); err != nil {
+		t.Fatal("Fail to init feature set, due to:", err)
+	}
+	s, err := c.GetSet("compact_rollback")
+	if err != nil {
+		t.Fatal("Fail to get feature set, due to:", err)
+	}
+
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	features := randomFeatures(r, 48, dims)
+	if err := s.Add(features...); err != nil {
+		t.Fatal("Fail to fill feature set, due to:", err)
+	}
+	// 3, 14 and 15 features left in the blocks, the first one is moved into the other two
+	var ids []FeatureID
+	for _, feature := range features[3:16] {
+		ids = append(ids, feature.ID)
+	}
+	ids = append(ids, features[16].ID, features[17].ID, features[32].ID)
+	if deleted, err := s.Delete(ids...); err != nil || len(deleted) != 16 {
+		t.Fatal("Fail to delete features, deleted:", deleted, "err:", err)
+	}
+
+	fs := s.(*FeatureSet)
+	last := fs.Blocks[2]
+	fs.Blocks[2] = failingBlock{last}
+	if _, err = s.Compact(); err == nil {
+		t.Fatal("Compact should fail if the features fail to insert")
+	}
+	size := 0
+	for _, block := range fs.Blocks {
+		size += block.Size()
+	}
+	if size != 32 {
+		t.Fatal("Features copied before the failure should be dropped, got features:", size)
+	}
+
+	for i, block := range fs.Blocks {
+		if failing, ok := block.(failingBlock); ok {
+			fs.Blocks[i] = failing.Block
+		}
+	}
+	if released, err := s.Compact(); err != nil || released != 1 {
+		t.Fatal("Fail to compact set, released:", released, "err:", err)
+	}
+	size = 0
+	for _, block := range fs.Blocks {
+		size += block.Size()
+	}
+	if size != 32 || s.Stats().Features != 32 {
+		t.Fatal("Fail to compact set, got features:", size)
+	}
+	for _, i := range []int{0, 1, 2, 18, 47} {
+		if ret, err := s.Read(features[i].ID); err != nil || string(ret[0].Value) != string(features[i].Value) {
+			t.Fatal("Fail to read feature after compaction, err:", err)
+		}
+	}
+}
@@ -67,7 +67,7 @@ func main() {
 		cache goFeature.Cache
 	)
 
-	cache, err = goFeature.NewCache(ctx, BlockNum, BlockSize)
+	cache, err = goFeature.NewCache(goFeature.NewGPUDevice(ctx), BlockNum, BlockSize)
 	if err != nil {
 		fmt.Println("Fail to init blocks, due to:", err)
 		return
@@ -76,7 +76,7 @@ func main() {
 	for i := 0; i < SetNum; i++ {
 		var ids []goFeature.FeatureID
 		name := fmt.Sprintf("test%d", i)
-		err := cache.NewSet(name, Dimension, Precision, Batch)
+		err := cache.NewSet(name, Dimension, Precision, Batch, goFeature.MetricCosine, goFeature.SetQuota{})
 		if err != nil {
 			fmt.Println("Fail to init feature set, due to:", err)
 			return
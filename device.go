@@ -0,0 +1,75 @@
+package goFeature
+
+import "runtime"
+
+// CPUDevice : host memory device, search features by brute-force
+type CPUDevice struct{}
+
+var _ Device = &CPUDevice{}
+
+func NewCPUDevice() *CPUDevice { return &CPUDevice{} }
+
+func (d *CPUDevice) NewBuffer(size int) (Buffer, error) { return NewCPUBuffer(size), nil }
+
+func (d *CPUDevice) NewKernel() (Kernel, error) { return &CPUKernel{}, nil }
+
+// CPUKernel : pure go implementation of kernel
+type CPUKernel struct{}
+
+var _ Kernel = &CPUKernel{}
+
+func (k *CPUKernel) MatMul(inputBuffer, matrixBuffer, outputBuffer Buffer, batch, height, dims int) (err error) {
+	input, err := TFloat32Value(inputBuffer.GetBuffer().([]byte)[:batch*dims*4])
+	if err != nil {
+		return
+	}
+	matrix, err := TFloat32Value(matrixBuffer.GetBuffer().([]byte)[:height*dims*4])
+	if err != nil {
+		return
+	}
+	output, err := TFloat32Value(outputBuffer.GetBuffer().([]byte)[:height*batch*4])
+	if err != nil {
+		return
+	}
+
+	// input is transposed as [dims][batch], turn it back to [batch][dims]
+	query := make([]float32, batch*dims)
+	for i := 0; i < dims; i++ {
+		for j := 0; j < batch; j++ {
+			query[j*dims+i] = input[i*batch+j]
+		}
+	}
+	for h := 0; h < height; h++ {
+		row := matrix[h*dims : (h+1)*dims]
+		for j := 0; j < batch; j++ {
+			q := query[j*dims : (j+1)*dims]
+			var score float32
+			for i, v := range row {
+				score += v * q[i]
+			}
+			output[h*batch+j] = score
+		}
+	}
+	return
+}
+
+func (k *CPUKernel) ReadBack(outputBuffer Buffer, count int) (scores []float32, err error) {
+	output, err := TFloat32Value(outputBuffer.GetBuffer().([]byte)[:count*4])
+	if err != nil {
+		return
+	}
+	scores = make([]float32, count)
+	copy(scores, output)
+	return
+}
+
+// SelectTopK : reference implementation of selection, the results of other kernels should be the same
+func (k *CPUKernel) SelectTopK(outputBuffer Buffer, batch, height, limit int, threshold float32, transform ScoreTransform) (indexes [][]int, values [][]float32, err error) {
+	scores, err := k.ReadBack(outputBuffer, batch*height)
+	if err != nil {
+		return
+	}
+	transform.Apply(scores, batch, height)
+	indexes, values = ParallelBatchTopKFloat32(scores, batch, height, limit, threshold, runtime.GOMAXPROCS(0))
+	return
+}
@@ -0,0 +1,5 @@
+// +build !cublas
+
+package goFeature
+
+func newTestDevice() Device { return NewCPUDevice() }
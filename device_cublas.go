@@ -0,0 +1,96 @@
+// +build cublas
+
+package goFeature
+
+import (
+	"errors"
+	"runtime"
+
+	"github.com/unixpickle/cuda"
+	"github.com/unixpickle/cuda/cublas"
+)
+
+// GPUDevice : cuda device, search features by cublas
+type GPUDevice struct {
+	Ctx       *cuda.Context
+	Allocator cuda.Allocator
+}
+
+var _ Device = &GPUDevice{}
+
+func NewGPUDevice(ctx *cuda.Context) *GPUDevice {
+	return &GPUDevice{
+		Ctx:       ctx,
+		Allocator: cuda.GCAllocator(cuda.NativeAllocator(ctx), 0),
+	}
+}
+
+func (d *GPUDevice) NewBuffer(size int) (Buffer, error) {
+	return NewGPUBuffer(d.Ctx, d.Allocator, size)
+}
+
+func (d *GPUDevice) NewKernel() (Kernel, error) {
+	handle, err := cublas.NewHandle(d.Ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &GPUKernel{Ctx: d.Ctx, Handle: handle}, nil
+}
+
+// GPUKernel : kernel based on cublas handle
+type GPUKernel struct {
+	Ctx    *cuda.Context
+	Handle *cublas.Handle
+}
+
+var _ Kernel = &GPUKernel{}
+
+func (k *GPUKernel) MatMul(inputBuffer, matrixBuffer, outputBuffer Buffer, batch, height, dims int) error {
+	return <-k.Ctx.Run(func() error {
+		var alpha, beta float32
+		alpha = 1.0
+		beta = 0.0
+		return k.Handle.Sgemm(
+			cublas.NoTrans,
+			cublas.NoTrans,
+			batch,
+			height,
+			dims,
+			&alpha,
+			inputBuffer.GetBuffer().(cuda.Buffer),
+			batch,
+			matrixBuffer.GetBuffer().(cuda.Buffer),
+			dims,
+			&beta,
+			outputBuffer.GetBuffer().(cuda.Buffer),
+			batch,
+		)
+	})
+}
+
+func (k *GPUKernel) ReadBack(outputBuffer Buffer, count int) (scores []float32, err error) {
+	output, err := outputBuffer.Slice(0, count*4)
+	if err != nil {
+		return nil, ErrSliceBuffer
+	}
+	scores = make([]float32, count)
+	err = <-k.Ctx.Run(func() (e error) {
+		if e = cuda.ReadBuffer(scores, output.GetBuffer().(cuda.Buffer)); e != nil {
+			return errors.New("fail to read buffer vec3, err:" + e.Error())
+		}
+		return nil
+	})
+	return
+}
+
+// SelectTopK : cublas has no selection routine, all the batch*height scores are read back and selected on host
+//	the transfer is the same as reading back the whole output, until a selection kernel is loaded
+func (k *GPUKernel) SelectTopK(outputBuffer Buffer, batch, height, limit int, threshold float32, transform ScoreTransform) (indexes [][]int, values [][]float32, err error) {
+	scores, err := k.ReadBack(outputBuffer, batch*height)
+	if err != nil {
+		return
+	}
+	transform.Apply(scores, batch, height)
+	indexes, values = ParallelBatchTopKFloat32(scores, batch, height, limit, threshold, runtime.GOMAXPROCS(0))
+	return
+}
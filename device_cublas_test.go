@@ -0,0 +1,19 @@
+// +build cublas
+
+package goFeature
+
+import (
+	"github.com/unixpickle/cuda"
+)
+
+func newTestDevice() Device {
+	devices, err := cuda.AllDevices()
+	if err != nil || len(devices) == 0 {
+		panic("no cuda device found")
+	}
+	ctx, err := cuda.NewContext(devices[0], -1)
+	if err != nil || ctx == nil {
+		panic("init cuda failed")
+	}
+	return NewGPUDevice(ctx)
+}
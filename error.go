@@ -1,9 +1,8 @@
-// +build cublas
-
 package goFeature
 
 import (
 	"errors"
+	"fmt"
 )
 
 var (
@@ -26,17 +25,27 @@ var (
 	ErrAllocatGPUMemory = errors.New("fail to allocate gpu memory")
 	ErrSliceGPUBuffer   = errors.New("fail to slice gpu buffer")
 	ErrNotEnoughBlocks  = errors.New("cache does not have enough blocks")
+	ErrInvalidQuota     = errors.New("invalid block quota")
+	ErrQuotaExceeded    = errors.New("set exceeds its max blocks")
 
 	// feature set error
 	ErrOutOfBatch        = errors.New("requests out of batch limit")
 	ErrMismatchDimension = errors.New("feature with mismatch dimension")
 	ErrWriteInputBuffer  = errors.New("failed to write input buffer")
 	ErrWriteOutputBuffer = errors.New("failed to write output buffer")
+	ErrInvalidMetric     = errors.New("invalid metric")
+	ErrInvalidAttribute  = errors.New("attribute value should be string, int or time")
+	ErrInvalidLimit      = errors.New("limit should be positive")
 
 	// block error
 	ErrBlockIsFull = errors.New("block is full")
 	ErrBlockUsed   = errors.New("block is used")
 
+	// snapshot error
+	ErrInvalidSnapshot = errors.New("invalid snapshot")
+	ErrSnapshotVersion = errors.New("unsupported snapshot version")
+	ErrInvalidWAL      = errors.New("invalid write-ahead log record")
+
 	// cuda error
 	ErrWriteCudaBuffer = errors.New("write to cuda buffer error")
 	ErrSliceBuffer     = errors.New("fail to slice cuda buffer")
@@ -47,3 +56,21 @@ var (
 	// feature error
 	ErrBadTransposeValue = errors.New("invalid transpose value to transpose")
 )
+
+// FeatureNotFoundError : some of the requested features are not found
+type FeatureNotFoundError struct {
+	IDs []FeatureID
+}
+
+func (e *FeatureNotFoundError) Error() string {
+	return fmt.Sprintf("features not found: %v", e.IDs)
+}
+
+// DuplicateFeatureError : features to be added are already in the set
+type DuplicateFeatureError struct {
+	IDs []FeatureID
+}
+
+func (e *DuplicateFeatureError) Error() string {
+	return fmt.Sprintf("features already exist: %v", e.IDs)
+}
@@ -0,0 +1,122 @@
+package goFeature
+
+import "sort"
+
+// ids held by each chunk of idIndex, a chunk is split once it is twice as large
+const idChunkSize = 512
+
+// idIndex : ids kept in order, stored as sorted chunks so that insert and delete
+//	only move one chunk, and a page after any id is found in O(log(N) + limit)
+type idIndex struct {
+	// sorted chunks of ids, ids of a chunk are less than the ones of the next chunk
+	chunks [][]FeatureID
+	// last id of each chunk
+	maxes []FeatureID
+}
+
+// Insert :
+//	insert ids not in index, the chunks they fall into are merged once
+func (x *idIndex) Insert(ids ...FeatureID) {
+	if len(ids) == 0 {
+		return
+	}
+	sorted := append([]FeatureID{}, ids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var (
+		chunks [][]FeatureID
+		i      int
+	)
+	for c, chunk := range x.chunks {
+		j := i
+		for j < len(sorted) && (c == len(x.chunks)-1 || sorted[j] <= x.maxes[c]) {
+			j++
+		}
+		if j == i {
+			chunks = append(chunks, chunk)
+			continue
+		}
+		chunks = append(chunks, splitIDs(mergeIDs(chunk, sorted[i:j]))...)
+		i = j
+	}
+	if i < len(sorted) {
+		chunks = append(chunks, splitIDs(sorted[i:])...)
+	}
+
+	x.chunks = chunks
+	x.maxes = make([]FeatureID, len(chunks))
+	for c, chunk := range chunks {
+		x.maxes[c] = chunk[len(chunk)-1]
+	}
+}
+
+// Delete :
+//	delete ids from index, ids not in index are ignored
+func (x *idIndex) Delete(ids ...FeatureID) {
+	for _, id := range ids {
+		c := sort.Search(len(x.maxes), func(i int) bool { return x.maxes[i] >= id })
+		if c == len(x.maxes) {
+			continue
+		}
+		chunk := x.chunks[c]
+		pos := sort.Search(len(chunk), func(i int) bool { return chunk[i] >= id })
+		if chunk[pos] != id {
+			continue
+		}
+		chunk = append(chunk[:pos], chunk[pos+1:]...)
+		if len(chunk) == 0 {
+			x.chunks = append(x.chunks[:c], x.chunks[c+1:]...)
+			x.maxes = append(x.maxes[:c], x.maxes[c+1:]...)
+			continue
+		}
+		x.chunks[c], x.maxes[c] = chunk, chunk[len(chunk)-1]
+	}
+}
+
+// After :
+//	at most N ids greater than cursor, in order
+func (x *idIndex) After(cursor FeatureID, limit int) (ids []FeatureID) {
+	c := sort.Search(len(x.maxes), func(i int) bool { return x.maxes[i] > cursor })
+	for ; c < len(x.chunks) && len(ids) < limit; c++ {
+		chunk := x.chunks[c]
+		pos := sort.Search(len(chunk), func(i int) bool { return chunk[i] > cursor })
+		if remain := limit - len(ids); len(chunk)-pos > remain {
+			chunk = chunk[:pos+remain]
+		}
+		ids = append(ids, chunk[pos:]...)
+	}
+	return
+}
+
+// mergeIDs : merge two sorted lists into a new one
+func mergeIDs(a, b []FeatureID) []FeatureID {
+	merged := make([]FeatureID, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if a[0] < b[0] {
+			merged, a = append(merged, a[0]), a[1:]
+		} else {
+			merged, b = append(merged, b[0]), b[1:]
+		}
+	}
+	merged = append(merged, a...)
+	return append(merged, b...)
+}
+
+// splitIDs : split the sorted ids into chunks of idChunkSize if it is too large
+//	chunks are capped, so appending to one never overwrites the next
+func splitIDs(ids []FeatureID) (chunks [][]FeatureID) {
+	if len(ids) <= 2*idChunkSize {
+		return [][]FeatureID{ids[:len(ids):len(ids)]}
+	}
+	for start := 0; start < len(ids); start += idChunkSize {
+		end := start + idChunkSize
+		if end > len(ids) || len(ids)-end < idChunkSize/2 {
+			end = len(ids)
+		}
+		chunks = append(chunks, ids[start:end:end])
+		if end == len(ids) {
+			break
+		}
+	}
+	return
+}
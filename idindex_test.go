@@ -0,0 +1,73 @@
+package goFeature
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestIDIndex(t *testing.T) {
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	var (
+		x      idIndex
+		expect []FeatureID
+	)
+	live := make(map[FeatureID]bool, 0)
+	// batches large enough to split chunks, and deletes to drop them
+	for round := 0; round < 20; round++ {
+		var ids []FeatureID
+		n := r.Intn(3 * idChunkSize)
+		for i := 0; i < n; i++ {
+			id := FeatureID(GetRandomString(8))
+			if !live[id] {
+				live[id] = true
+				ids = append(ids, id)
+			}
+		}
+		x.Insert(ids...)
+		var del []FeatureID
+		for id := range live {
+			if r.Intn(3) == 0 {
+				del = append(del, id)
+				delete(live, id)
+			}
+		}
+		x.Delete(append(del, "missing")...)
+	}
+	for id := range live {
+		expect = append(expect, id)
+	}
+	sort.Slice(expect, func(i, j int) bool { return expect[i] < expect[j] })
+
+	for c, chunk := range x.chunks {
+		if len(chunk) == 0 || len(chunk) > 2*idChunkSize || x.maxes[c] != chunk[len(chunk)-1] {
+			t.Fatal("Wrong chunk", c, "size:", len(chunk))
+		}
+	}
+	if ids := x.After("", len(expect)+1); len(ids) != len(expect) {
+		t.Fatal("Wrong id number, got:", len(ids), "expect:", len(expect))
+	}
+	for _, limit := range []int{1, 7, idChunkSize + 1} {
+		var (
+			cursor FeatureID
+			got    []FeatureID
+		)
+		for {
+			ids := x.After(cursor, limit)
+			if len(ids) == 0 {
+				break
+			}
+			got = append(got, ids...)
+			cursor = ids[len(ids)-1]
+		}
+		if len(got) != len(expect) {
+			t.Fatal("Wrong scanned number, limit:", limit, "got:", len(got), "expect:", len(expect))
+		}
+		for i := range got {
+			if got[i] != expect[i] {
+				t.Fatal("Wrong id order, limit:", limit, "at:", i, "got:", got[i], "expect:", expect[i])
+			}
+		}
+	}
+}
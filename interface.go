@@ -1,11 +1,8 @@
-// +build cublas
-
 package goFeature
 
 import (
 	"context"
-
-	"github.com/unixpickle/cuda/cublas"
+	"io"
 )
 
 // Cache : interface of cache, the main object of features
@@ -15,7 +12,9 @@ type Cache interface {
 	//  - dims: dimension of feature
 	//  - precision: precision of feature
 	//  - batch: max batch size of feature search
-	NewSet(name string, dims int, precision int, batch int) error
+	//  - metric: metric to compare features, inner product if MetricDefault
+	//  - quota: blocks reserved for the set and max blocks it can accquire
+	NewSet(name string, dims int, precision int, batch int, metric Metric, quota SetQuota) error
 
 	// DestroySet: destroy the set, release all the resource accquired
 	//	- name: set name, unique
@@ -25,18 +24,48 @@ type Cache interface {
 	//	- name: set name, unique
 	GetSet(name string) (Set, error)
 
+	// ListSets: get names of all the sets, in sorted order
+	ListSets() []string
+
 	// GetBlockSize: get the blocksize of linked blocks
 	GetBlockSize() int
 
-	// GetEmptyBlock: try to get blocks which not accquired
+	// GetEmptyBlock: try to get blocks which not accquired, blocks may be accquired by others after return
 	//  - blocknum: block number to be accquired
 	GetEmptyBlock(blocknum int) ([]Block, error)
+
+	// AccquireBlocks: get empty blocks and accquire them atomically, all or nothing
+	//  - owner: set name, blocks reserved for other sets are not accquired, ErrQuotaExceeded if over its max blocks
+	//  - blocknum: block number to be accquired
+	//  - accquire: function to accquire one block, blocks accquired are released if it fails
+	AccquireBlocks(owner string, blocknum int, accquire func(block Block) error) ([]Block, error)
+
+	// GetBlockOwners: get the owner of each block, empty if not owned
+	GetBlockOwners() []string
+
+	// Stats: get usage statistics of the cache and all the sets
+	Stats() CacheStats
+
+	// Snapshot: write all the sets into w, restored by RestoreCache
+	//  the write-ahead log attached is truncated after a successful snapshot
+	//  - w: writer of the snapshot
+	Snapshot(w io.Writer) error
+
+	// SetWAL: attach write-ahead log, Add/Delete/Update of all the sets are logged since then
+	//  - wal: write-ahead log, replayed by WAL.Replay before attached
+	SetWAL(wal *WAL)
+
+	// RestoreSet: restore a set from the snapshot written by Set.Snapshot
+	//  - r: reader of the snapshot
+	//  - name: name of the set restored
+	RestoreSet(r io.Reader) (name string, err error)
 }
 
 // Set : interface of set
 type Set interface {
-	// Add: add features to set
+	// Add: add features to set, feature id must be unique in the set
 	// 	- features: features to be added
+	//  - err: *DuplicateFeatureError if any id is already in the set, nothing added
 	Add(features ...Feature) error
 
 	// Delete: try to delete features by id
@@ -44,25 +73,96 @@ type Set interface {
 	//  - deleted: feature ids deleted after function calling, nil if no one found
 	Delete(ids ...FeatureID) (deleted []FeatureID, err error)
 
-	// Update: try to update features
-	//  - features: feature to be deleted
+	// Update: try to update features, the vectors are overwritten in place
+	//  - features: feature to be updated, attributes are kept if nil
 	//  - updated: feature ids updated after function calling, nil if no one found
 	Update(features ...Feature) (updated []FeatureID, err error)
 
+	// Upsert: update features, add the ones not found
+	//  - features: feature to be updated or added
+	//  - updated: feature ids updated after function calling
+	//  - inserted: feature ids added after function calling
+	Upsert(features ...Feature) (updated, inserted []FeatureID, err error)
+
 	// Read: try to read features by id
 	//  - ids: feature id to be read
-	//  - features: feature got after function calling, nil if no one found
+	//  - features: feature got after function calling in the order of ids, nil if no one found
+	//  - err: *FeatureNotFoundError with the missing ids if any id is not found
 	Read(ids ...FeatureID) (features []Feature, err error)
 
 	// Destroy: destroy the set, release all the blocks accquired
 	Destroy() error
 
+	// Compact: fill the deleted slots of blocks, and release the blocks become empty
+	//  - released: number of blocks released
+	Compact() (released int, err error)
+
+	// SetCompactPolicy: compact the set in background by policy
+	//  - policy: compaction policy, stop background compaction if policy.Interval is zero
+	SetCompactPolicy(policy CompactPolicy)
+
+	// Scan: get live features page by page in the order of id
+	//  - cursor: start after the id, empty for the first page
+	//  - limit: max number of features in the page
+	//  - withValue: fill feature value and attributes, only ids if false
+	//  - next: cursor of the next page, empty if no more features
+	Scan(cursor FeatureID, limit int, withValue bool) (features []Feature, next FeatureID, err error)
+
+	// SetCoalescePolicy: merge concurrent single-query searches into one batch by policy
+	//  - policy: coalescing policy, stop merging if policy.Window is zero
+	SetCoalescePolicy(policy CoalescePolicy)
+
+	// Info: get configuration of the set
+	Info() SetInfo
+
+	// Stats: get usage statistics of the set
+	Stats() SetStats
+
+	// Snapshot: write the set config and features into w, restored by Cache.RestoreSet
+	//  - w: writer of the snapshot
+	Snapshot(w io.Writer) error
+
 	// Search: search targe features
 	//  - threshold: score threshold for search
 	//	- limit: top N result
-	//	- features: target features value
+	//	- features: target features value, split into chunks of the set batch if there are more
 	//	- ret: search results
 	Search(threshold FeatureScore, limit int, features ...FeatureValue) (ret [][]FeatureSearchResult, err error)
+
+	// SearchContext: search targe features, abandoned once ctx is done
+	//  - ctx: context with cancellation or deadline, ctx.Err() is returned once it is done
+	//  - threshold: score threshold for search
+	//	- limit: top N result
+	//	- features: target features value
+	//	- ret: search results
+	SearchContext(ctx context.Context, threshold FeatureScore, limit int, features ...FeatureValue) (ret [][]FeatureSearchResult, err error)
+
+	// SearchWithOptions: search targe features with options
+	//  - ctx: context with cancellation or deadline, ctx.Err() is returned once it is done
+	//  - opts: search options
+	//	- features: target features value, split into chunks of the set batch if there are more, unless opts.Strict
+	//	- ret: search results, in the order of features
+	SearchWithOptions(ctx context.Context, opts SearchOptions, features ...FeatureValue) (ret [][]FeatureSearchResult, err error)
+
+	// SearchByID: search stored features by id, the stored vectors are used as targets
+	//  - ctx: context with cancellation or deadline, ctx.Err() is returned once it is done
+	//  - opts: search options, exclude the target itself from results if opts.ExcludeSelf
+	//	- ids: feature id of targets, FeatureNotFoundError if any is missing
+	//	- ret: search results, in the order of ids
+	SearchByID(ctx context.Context, opts SearchOptions, ids ...FeatureID) (ret [][]FeatureSearchResult, err error)
+
+	// RangeSearch: search all the features with score no less than threshold, however many
+	//  - threshold: score threshold for search
+	//	- features: target features value
+	//	- ret: search results, in descending order of score
+	RangeSearch(threshold FeatureScore, features ...FeatureValue) (ret [][]FeatureSearchResult, err error)
+
+	// RangeSearchWithOptions: range search with options, opts.Limit is ignored
+	//  - ctx: context with cancellation or deadline, ctx.Err() is returned once it is done
+	//  - opts: search options, opts.Threshold is the score threshold
+	//	- features: target features value
+	//	- ret: search results, in descending order of score
+	RangeSearchWithOptions(ctx context.Context, opts SearchOptions, features ...FeatureValue) (ret [][]FeatureSearchResult, err error)
 }
 
 // Block : interface of block, the basic scheuling unit
@@ -73,21 +173,41 @@ type Block interface {
 	// Margin: number of features can be inserted
 	Margin() int
 
+	// Size: number of features stored
+	Size() int
+
+	// Deleted: number of deleted slots not reused
+	Deleted() int
+
 	// IsOwned: check if accquired
 	IsOwned() bool
 
+	// GetOwner: get the set name which accquired the block, empty if not owned
+	GetOwner() string
+
 	// Accquire: one set tries to accquire the block
-	//  - handle: cublas handle created by set
+	//  - kernel: compute kernel created by set
 	//  - owner: set name, unique
 	//  - dims: dimension of feature
 	//  - precision: precision of feature
 	//  - batch: batch limit of the set
-	//  - worker: search worker function of the set
-	Accquire(handle *cublas.Handle, owner string, dims int, premision int, batch int, worker func(context.Context, Buffer, Buffer)) error
+	Accquire(kernel Kernel, owner string, dims int, premision int, batch int) error
 
 	// Release: release the accquired block
 	Release() error
 
+	// Dump: dump the layout and features of the block
+	//  - snapshot: copy of the block content
+	Dump() (snapshot BlockSnapshot, err error)
+
+	// Load: load the layout and features into the accquired block
+	//  - snapshot: block content dumped before
+	Load(snapshot BlockSnapshot) error
+
+	// Compact: move features to fill the deleted slots, and lower the used rows
+	//  - moved: number of features moved
+	Compact() (moved int, err error)
+
 	// Insert: insert features into the block
 	//  - features: features to be inserted
 	Insert(features ...Feature) error
@@ -97,8 +217,8 @@ type Block interface {
 	//  - deleted: feature ids deleted after function calling, nil if no one found
 	Delete(...FeatureID) (deleted []FeatureID, err error)
 
-	// Update: try to update features
-	//  - features: feature to be deleted
+	// Update: try to update features, the vectors are overwritten in place
+	//  - features: feature to be updated
 	//  - updated: feature ids updated after function calling, nil if no one found
 	Update(features ...Feature) (updated []FeatureID, err error)
 
@@ -107,13 +227,12 @@ type Block interface {
 	//  - features: feature got after function calling, nil if no one found
 	Read(ids ...FeatureID) (features []Feature, err error)
 
-	// Search: search targe features
-	//  - inputBuffer: buffer stored target features value
-	//  - outputBuffer: buffer to store search result, temporary
-	//  - batch: max search batch size
-	//	- limit: top N result
+	// Search: search targe features, searches of the block are serialized on its output buffer
+	//  - inputBuffer: buffer stored transposed target features value, shared by blocks
+	//  - batch: search batch size, no more than the batch limit of the set
+	//	- opts: search options, top N result by opts.Limit
 	//	- ret: search results
-	Search(inputBuffer, outputBuffer Buffer, batch int, limit int) (ret [][]FeatureSearchResult, err error)
+	Search(inputBuffer Buffer, batch int, opts SearchOptions) (ret [][]FeatureSearchResult, err error)
 }
 
 // Buffer : buffer in memory for both CPU and GPU
@@ -141,3 +260,38 @@ type Buffer interface {
 	// Size: get the size of the buffer
 	Size() int
 }
+
+// Device : compute device which holds the feature memory, such as cpu or gpu
+type Device interface {
+	// NewBuffer: allocate a cleared buffer on the device
+	//  - size: buffer size in bytes
+	NewBuffer(size int) (Buffer, error)
+
+	// NewKernel: create a compute kernel on the device, one for each set
+	NewKernel() (Kernel, error)
+}
+
+// Kernel : compute routines of a device used by block search
+type Kernel interface {
+	// MatMul: multiply target features with block features, float32 only
+	//  - input: target features value, transposed as [dims][batch]
+	//  - matrix: features stored in block, [height][dims]
+	//  - output: buffer to store scores, [height][batch]
+	MatMul(input, matrix, output Buffer, batch, height, dims int) error
+
+	// ReadBack: read scores from device buffer to host
+	//  - output: buffer stored scores
+	//  - count: number of scores to be read
+	ReadBack(output Buffer, count int) ([]float32, error)
+
+	// SelectTopK: convert products in output buffer to scores, and select top N scores no less than threshold
+	// for each target. selection on device to read back only the top N results is not done yet,
+	// GPUKernel still reads back the whole [height][batch] scores and selects on host
+	//  - output: buffer stored products of MatMul, [height][batch]
+	//	- limit: top N result
+	//  - threshold: scores less than threshold are not selected
+	//  - transform: conversion from product to score
+	//  - indexes: feature index in block of each target, sorted by score
+	//  - values: scores of each target, sorted
+	SelectTopK(output Buffer, batch, height, limit int, threshold float32, transform ScoreTransform) (indexes [][]int, values [][]float32, err error)
+}
@@ -0,0 +1,181 @@
+package goFeature
+
+import (
+	"time"
+)
+
+// Predicate : condition on feature attributes, used to filter search candidates
+type Predicate interface {
+	// Match: check if the attributes satisfy the condition
+	//  - attrs: attributes of feature, may be nil
+	Match(attrs Attributes) bool
+}
+
+// Eq : attribute key equals to value
+func Eq(key string, value interface{}) Predicate {
+	return &inPredicate{Key: key, Values: []interface{}{value}}
+}
+
+// In : attribute key equals to one of values
+func In(key string, values ...interface{}) Predicate {
+	return &inPredicate{Key: key, Values: values}
+}
+
+// Range : attribute key in [min, max], nil bound is unlimited
+func Range(key string, min, max interface{}) Predicate {
+	return &rangePredicate{Key: key, Min: min, Max: max}
+}
+
+// Exists : attribute key is set
+func Exists(key string) Predicate { return &existsPredicate{Key: key} }
+
+// And : all predicates are satisfied
+func And(predicates ...Predicate) Predicate { return &andPredicate{Predicates: predicates} }
+
+// Or : any of predicates is satisfied
+func Or(predicates ...Predicate) Predicate { return &orPredicate{Predicates: predicates} }
+
+// Not : predicate is not satisfied
+func Not(predicate Predicate) Predicate { return &notPredicate{Predicate: predicate} }
+
+type inPredicate struct {
+	Key    string
+	Values []interface{}
+}
+
+func (p *inPredicate) Match(attrs Attributes) bool {
+	value, exist := attrs[p.Key]
+	if !exist {
+		return false
+	}
+	for _, v := range p.Values {
+		if ret, ok := compareAttribute(value, v); ok && ret == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+type rangePredicate struct {
+	Key string
+	Min interface{}
+	Max interface{}
+}
+
+func (p *rangePredicate) Match(attrs Attributes) bool {
+	value, exist := attrs[p.Key]
+	if !exist {
+		return false
+	}
+	if p.Min != nil {
+		if ret, ok := compareAttribute(value, p.Min); !ok || ret < 0 {
+			return false
+		}
+	}
+	if p.Max != nil {
+		if ret, ok := compareAttribute(value, p.Max); !ok || ret > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type existsPredicate struct {
+	Key string
+}
+
+func (p *existsPredicate) Match(attrs Attributes) bool {
+	_, exist := attrs[p.Key]
+	return exist
+}
+
+type andPredicate struct {
+	Predicates []Predicate
+}
+
+func (p *andPredicate) Match(attrs Attributes) bool {
+	for _, predicate := range p.Predicates {
+		if !predicate.Match(attrs) {
+			return false
+		}
+	}
+	return true
+}
+
+type orPredicate struct {
+	Predicates []Predicate
+}
+
+func (p *orPredicate) Match(attrs Attributes) bool {
+	for _, predicate := range p.Predicates {
+		if predicate.Match(attrs) {
+			return true
+		}
+	}
+	return false
+}
+
+type notPredicate struct {
+	Predicate Predicate
+}
+
+func (p *notPredicate) Match(attrs Attributes) bool { return !p.Predicate.Match(attrs) }
+
+// compareAttribute :
+//	compare two attribute values, ok is false if they are not comparable
+func compareAttribute(a, b interface{}) (ret int, ok bool) {
+	switch x := a.(type) {
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	case time.Time:
+		y, ok := b.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x.Before(y):
+			return -1, true
+		case x.After(y):
+			return 1, true
+		}
+		return 0, true
+	}
+
+	x, ok := attributeInt64(a)
+	if !ok {
+		return 0, false
+	}
+	y, ok := attributeInt64(b)
+	if !ok {
+		return 0, false
+	}
+	switch {
+	case x < y:
+		return -1, true
+	case x > y:
+		return 1, true
+	}
+	return 0, true
+}
+
+func attributeInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	}
+	return 0, false
+}
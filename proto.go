@@ -1,5 +1,7 @@
 package goFeature
 
+import "time"
+
 // FeatureValue : bytes in little endian
 type FeatureValue []byte
 
@@ -9,12 +11,17 @@ type FeatureID string
 // FeatureScore : match score, float32
 type FeatureScore float32
 
+// Attributes : metadata of feature, value should be string, int, int64 or time.Time
+type Attributes map[string]interface{}
+
 // Feature : base struct for vector feture
 type Feature struct {
 	// feature value, dimesion * precison
 	Value FeatureValue
 	// unique index of feature
 	ID FeatureID
+	// optional metadata stored alongside the feature
+	Attributes Attributes
 }
 
 // FeatureSearchResult : result for feature search
@@ -23,4 +30,150 @@ type FeatureSearchResult struct {
 	Score FeatureScore
 	// catched feature id
 	ID FeatureID
+	// feature value, only filled if IncludeVectors is set in SearchOptions
+	Value FeatureValue
+	// metadata of catched feature, read only
+	Attributes Attributes
+}
+
+// Metric : metric to compare features
+type Metric int
+
+// score is always higher for more similar features
+const (
+	// use the metric of the set, inner product for set
+	MetricDefault Metric = iota
+	// inner product of features
+	MetricInnerProduct
+	// cosine similarity, features are normalized on insert and on query
+	MetricCosine
+	// negative squared euclidean distance
+	MetricL2
+)
+
+// SearchOptions : options for feature search
+type SearchOptions struct {
+	// score threshold for search
+	Threshold FeatureScore
+	// top N result
+	Limit int
+	// only search in features with these ids, all features if empty
+	IDs []FeatureID
+	// only search in features whose attributes match the predicate, all features if nil
+	Filter Predicate
+	// fill feature value in search results
+	IncludeVectors bool
+	// override the metric of the set
+	Metric Metric
+	// search timeout, no timeout if zero
+	Timeout time.Duration
+	// fail with ErrOutOfBatch if there are more targets than the set batch, instead of splitting them
+	Strict bool
+	// chunks of targets searched concurrently when split, one at a time if zero
+	Concurrency int
+	// exclude the target feature itself from results, only for search by id
+	ExcludeSelf bool
+
+	// squared norms of target features, filled by set for L2
+	norms []float32
+	// return all the results no less than threshold, set by range search
+	unlimited bool
+}
+
+// BlockSnapshot : layout and features of a block
+type BlockSnapshot struct {
+	// next slot index never used
+	NextIndex int
+	// deleted slots
+	Empty []int
+	// feature id of slots, [NextIndex], empty if deleted
+	IDs []FeatureID
+	// feature attributes of slots, [NextIndex]
+	Attrs []Attributes
+	// feature values of slots, [NextIndex][dims * precision]
+	Value FeatureValue
+}
+
+// CompactPolicy : policy of background compaction
+type CompactPolicy struct {
+	// check interval, background compaction is stopped if zero
+	Interval time.Duration
+	// compact if deleted slots / used slots >= Fragmentation
+	Fragmentation float64
+}
+
+// CoalescePolicy : policy of merging concurrent single-query searches
+type CoalescePolicy struct {
+	// max time to wait for more searches, searches are not merged if zero
+	Window time.Duration
+	// max searches in one batch, the batch of set if zero
+	MaxBatch int
+}
+
+// SetQuota : block quota of a feature set
+type SetQuota struct {
+	// blocks reserved for the set, which can not be accquired by other sets
+	MinBlocks int
+	// max blocks the set can accquire, no limit if zero
+	MaxBlocks int
+}
+
+// SetInfo : configuration of a feature set
+type SetInfo struct {
+	Name      string
+	Dims      int
+	Precision int
+	Batch     int
+	Metric    Metric
+	// live features
+	Features int
+	// blocks accquired by the set
+	Blocks int
+	Quota  SetQuota
+	// time when the set was created in the cache
+	Created time.Time
+}
+
+// SetStats : usage statistics of a feature set
+type SetStats struct {
+	// blocks accquired by the set
+	Blocks int
+	// feature slots of all the blocks
+	Capacity int
+	// live features
+	Features int
+	// deleted slots not reused
+	Deleted int
+	// slots never used or reusable
+	Free int
+	// deleted slots / used slots
+	Fragmentation float64
+	// bytes of live feature vectors
+	VectorBytes int
+	// bytes of per-block output and per-search input scratch buffers
+	ScratchBytes int
+	// searches running or waiting to be coalesced
+	QueueDepth int
+}
+
+// CacheStats : usage statistics of a cache
+type CacheStats struct {
+	// feature sets in the cache
+	Sets int
+	// blocks in the cache
+	TotalBlocks int
+	// blocks accquired by sets
+	UsedBlocks int
+	// blocks not accquired
+	FreeBlocks int
+	// live features of all the sets
+	Features int
+	// deleted slots not reused of all the sets
+	Deleted int
+	// bytes of live feature vectors of all the sets
+	VectorBytes int
+	// bytes of scratch buffers of all the sets
+	ScratchBytes int
+	// searches running or waiting to be coalesced of all the sets
+	QueueDepth int
 }
@@ -0,0 +1,98 @@
+package goFeature
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestScan(t *testing.T) {
+	const (
+		dims      = 8
+		blockSize = 16 * dims * 4
+	)
+	c, err := NewCache(newTestDevice(), 4, blockSize)
+	if err != nil {
+		t.Fatal("Fail to init cache, due to:", err)
+	}
+	if err = c.NewSet("scan", dims, 4, 2, MetricDefault, SetQuota{}); err != nil {
+		t.Fatal("Fail to init feature set, due to:", err)
+	}
+	s, err := c.GetSet("scan")
+	if err != nil {
+		t.Fatal("Fail to get feature set, due to:", err)
+	}
+
+	if _, _, err := s.Scan("", 0, false); err != ErrInvalidLimit {
+		t.Fatal("Scan should fail with invalid limit, err:", err)
+	}
+
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	features := randomFeatures(r, 30, dims)
+	features[0].Attributes = Attributes{"camera": "c1"}
+	if err := s.Add(features...); err != nil {
+		t.Fatal("Fail to fill feature set, due to:", err)
+	}
+	values := make(map[FeatureID]Feature, len(features))
+	for _, feature := range features {
+		values[feature.ID] = feature
+	}
+
+	// mutate between pages, features kept during the scan should be returned exactly once
+	deleted := map[FeatureID]bool{features[1].ID: true, features[2].ID: true}
+	seen := make(map[FeatureID]int, 0)
+	var (
+		cursor FeatureID
+		pages  int
+	)
+	for {
+		page, next, err := s.Scan(cursor, 7, true)
+		if err != nil || len(page) > 7 {
+			t.Fatal("Fail to scan set, page:", len(page), "err:", err)
+		}
+		for _, feature := range page {
+			if feature.ID <= cursor {
+				t.Fatal("Scan should be in order of id, got:", feature.ID, "after:", cursor)
+			}
+			if v, exist := values[feature.ID]; exist && string(feature.Value) != string(v.Value) {
+				t.Fatal("Wrong feature value of", feature.ID)
+			}
+			if feature.ID == features[0].ID && feature.Attributes["camera"] != "c1" {
+				t.Fatal("Wrong feature attributes:", feature.Attributes)
+			}
+			seen[feature.ID]++
+			cursor = feature.ID
+		}
+		if pages++; pages == 1 {
+			ids := []FeatureID{}
+			for id := range deleted {
+				ids = append(ids, id)
+			}
+			if _, err = s.Delete(ids...); err != nil {
+				t.Fatal("Fail to delete features, due to:", err)
+			}
+			if _, err = s.Compact(); err != nil {
+				t.Fatal("Fail to compact set, due to:", err)
+			}
+			if err = s.Add(randomFeatures(r, 5, dims)...); err != nil {
+				t.Fatal("Fail to add features, due to:", err)
+			}
+		}
+		if next == "" {
+			break
+		}
+		if next != cursor {
+			t.Fatal("Next cursor should be the last id of the page, next:", next, "last:", cursor)
+		}
+	}
+	for _, feature := range features {
+		if !deleted[feature.ID] && seen[feature.ID] != 1 {
+			t.Fatal("Feature", feature.ID, "scanned", seen[feature.ID], "times")
+		}
+	}
+
+	page, next, err := s.Scan("", 100, false)
+	if err != nil || len(page) != 33 || next != "" || page[0].Value != nil {
+		t.Fatal("Fail to scan ids, page:", len(page), "next:", next, "err:", err)
+	}
+}
@@ -1,15 +1,12 @@
-// +build cublas
-
 package goFeature
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
+	"sync"
 	"testing"
 	"time"
-
-	"github.com/unixpickle/cuda"
-	"github.com/unixpickle/cuda/cublas"
 )
 
 const (
@@ -22,33 +19,19 @@ const (
 )
 
 var (
-	ctx    *cuda.Context
-	cache  Cache
-	set    Set
-	handle *cublas.Handle
+	cache Cache
+	set   Set
 )
 
 func init() {
 	var err error
-	devices, err := cuda.AllDevices()
-	if err != nil {
-		// Handle error.
-	}
-	if len(devices) == 0 {
-		// No devices found.
-	}
-	ctx, err = cuda.NewContext(devices[0], -1)
-	if err != nil || ctx == nil {
-		panic("init cuda failed")
-	}
-
-	cache, err = NewCache(ctx, blockNum, blockSize)
+	cache, err = NewCache(newTestDevice(), blockNum, blockSize)
 	if err != nil {
 		panic(fmt.Sprint("Fail to init blocks, due to:", err))
 	}
 
 	name := "search_benchmark"
-	err = cache.NewSet(name, dims, premision, batch)
+	err = cache.NewSet(name, dims, premision, batch, MetricDefault, SetQuota{})
 	if err != nil {
 		panic(fmt.Sprint("Fail to init feature set, due to:", err))
 	}
@@ -79,7 +62,7 @@ func TestBasicSearch(t *testing.T) {
 		err error
 		ret [][]FeatureSearchResult
 	)
-	if err = cache.NewSet("basic_search", 5, 4, 5); err != nil {
+	if err = cache.NewSet("basic_search", 5, 4, 5, MetricDefault, SetQuota{}); err != nil {
 		panic(fmt.Sprint("Fail to init feature set, due to:", err))
 	}
 	set, _ := cache.GetSet("basic_search")
@@ -144,6 +127,470 @@ func TestBasicSearch(t *testing.T) {
 	}
 }
 
+func randomFeatures(r *rand.Rand, n, dims int) (features []Feature) {
+	for i := 0; i < n; i++ {
+		var value []float32
+		for j := 0; j < dims; j++ {
+			value = append(value, r.Float32()*2-1)
+		}
+		feature := Feature{ID: FeatureID(GetRandomString(12))}
+		feature.Value, _ = TFeatureValue(NoramlizeFloat32(value))
+		features = append(features, feature)
+	}
+	return
+}
+
+func TestReadFeature(t *testing.T) {
+	if err := cache.NewSet("read_feature", 8, 4, 2, MetricDefault, SetQuota{}); err != nil {
+		t.Fatal("Fail to init feature set, due to:", err)
+	}
+	defer cache.DestroySet("read_feature")
+	set, _ := cache.GetSet("read_feature")
+
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	features := randomFeatures(r, 10, 8)
+	if err := set.Add(features...); err != nil {
+		t.Fatal("Fail to fill feature set, due to:", err)
+	}
+	if _, err := set.Delete(features[3].ID); err != nil {
+		t.Fatal("Fail to delete feature, due to:", err)
+	}
+
+	ret, err := set.Read(features[5].ID, features[3].ID, features[0].ID)
+	notFound, ok := err.(*FeatureNotFoundError)
+	if !ok || len(notFound.IDs) != 1 || notFound.IDs[0] != features[3].ID {
+		t.Fatal("Fail to report missing feature, err:", err)
+	}
+	if len(ret) != 2 || ret[0].ID != features[5].ID || ret[1].ID != features[0].ID ||
+		string(ret[0].Value) != string(features[5].Value) || string(ret[1].Value) != string(features[0].Value) {
+		t.Fatal("Fail to read features, ret:", ret)
+	}
+}
+
+func TestUpdateFeature(t *testing.T) {
+	if err := cache.NewSet("update_feature", 8, 4, 2, MetricDefault, SetQuota{}); err != nil {
+		t.Fatal("Fail to init feature set, due to:", err)
+	}
+	defer cache.DestroySet("update_feature")
+	set, _ := cache.GetSet("update_feature")
+
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	features := randomFeatures(r, 10, 8)
+	if err := set.Add(features...); err != nil {
+		t.Fatal("Fail to fill feature set, due to:", err)
+	}
+
+	values := randomFeatures(r, 2, 8)
+	target := Feature{ID: features[4].ID, Value: values[0].Value}
+	updated, err := set.Update(target, values[1])
+	if err != nil || len(updated) != 1 || updated[0] != target.ID {
+		t.Fatal("Fail to update feature, updated:", updated, "err:", err)
+	}
+	ret, err := set.Search(0.99, 1, target.Value)
+	if err != nil || len(ret[0]) != 1 || ret[0][0].ID != target.ID {
+		t.Fatal("Fail to search updated feature, ret:", ret, "err:", err)
+	}
+
+	updated, inserted, err := set.Upsert(target, values[1])
+	if err != nil || len(updated) != 1 || len(inserted) != 1 || inserted[0] != values[1].ID {
+		t.Fatal("Fail to upsert feature, updated:", updated, "inserted:", inserted, "err:", err)
+	}
+	if ret, err := set.Read(values[1].ID); err != nil || string(ret[0].Value) != string(values[1].Value) {
+		t.Fatal("Fail to read upserted feature, err:", err)
+	}
+
+	// a short value would overwrite the slot of the next feature
+	short := Feature{ID: "short", Value: values[0].Value[:4]}
+	if err = set.Add(short, randomFeatures(r, 1, 8)[0]); err != ErrMismatchDimension {
+		t.Fatal("Add should fail with mismatch dimension, err:", err)
+	}
+	if _, _, err = set.Upsert(short); err != ErrMismatchDimension {
+		t.Fatal("Upsert should fail with mismatch dimension, err:", err)
+	}
+	if info := set.Info(); info.Features != 11 {
+		t.Fatal("Features of wrong length should not be added, got:", info.Features)
+	}
+	if ret, err := set.Read(features[5].ID); err != nil || string(ret[0].Value) != string(features[5].Value) {
+		t.Fatal("Stored feature should not be changed, err:", err)
+	}
+}
+
+func TestConcurrentUpsert(t *testing.T) {
+	if err := cache.NewSet("concurrent_upsert", 8, 4, 2, MetricDefault, SetQuota{}); err != nil {
+		t.Fatal("Fail to init feature set, due to:", err)
+	}
+	defer cache.DestroySet("concurrent_upsert")
+	set, _ := cache.GetSet("concurrent_upsert")
+
+	// the same new ids upserted by all the callers at once
+	const rounds = 100
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	values := randomFeatures(r, 8, 8)
+	var wg sync.WaitGroup
+	for i := range values {
+		wg.Add(1)
+		go func(value FeatureValue) {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				if _, _, err := set.Upsert(Feature{ID: FeatureID(fmt.Sprint("upsert_", j)), Value: value}); err != nil {
+					t.Error("Fail to upsert feature, due to:", err)
+					return
+				}
+			}
+		}(values[i].Value)
+	}
+	wg.Wait()
+	if info := set.Info(); info.Features != rounds {
+		t.Fatal("Each feature should be added once, got:", info.Features)
+	}
+}
+
+func TestDuplicateFeature(t *testing.T) {
+	if err := cache.NewSet("duplicate_feature", 8, 4, 2, MetricDefault, SetQuota{}); err != nil {
+		t.Fatal("Fail to init feature set, due to:", err)
+	}
+	defer cache.DestroySet("duplicate_feature")
+	set, _ := cache.GetSet("duplicate_feature")
+
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	features := randomFeatures(r, 3, 8)
+	if err := set.Add(features...); err != nil {
+		t.Fatal("Fail to fill feature set, due to:", err)
+	}
+	others := randomFeatures(r, 1, 8)
+	err := set.Add(others[0], features[1])
+	if dup, ok := err.(*DuplicateFeatureError); !ok || len(dup.IDs) != 1 || dup.IDs[0] != features[1].ID {
+		t.Fatal("Fail to reject duplicate feature, err:", err)
+	}
+	if err = set.Add(others[0], others[0]); err == nil {
+		t.Fatal("Fail to reject duplicate feature in one request")
+	}
+	if _, err = set.Read(others[0].ID); err == nil {
+		t.Fatal("Rejected feature should not be added")
+	}
+
+	ret, err := set.Search(-1, 5, features[1].Value)
+	if err != nil || len(ret[0]) != 3 || ret[0][0].ID != features[1].ID {
+		t.Fatal("Fail to search features, ret:", ret, "err:", err)
+	}
+}
+
+func TestSearchContext(t *testing.T) {
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	target := randomFeatures(r, 1, dims)[0].Value
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := set.SearchContext(ctx, 0, 1, target); err != context.Canceled {
+		t.Fatal("Search with canceled context should fail, err:", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if ret, err := set.SearchContext(ctx, -1, 1, target); err != nil || len(ret) != 1 || len(ret[0]) != 1 {
+		t.Fatal("Fail to search with context, ret:", ret, "err:", err)
+	}
+}
+
+func TestSearchWithOptions(t *testing.T) {
+	if err := cache.NewSet("search_options", 8, 4, 2, MetricDefault, SetQuota{}); err != nil {
+		t.Fatal("Fail to init feature set, due to:", err)
+	}
+	defer cache.DestroySet("search_options")
+	set, _ := cache.GetSet("search_options")
+
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	features := randomFeatures(r, 10, 8)
+	if err := set.Add(features...); err != nil {
+		t.Fatal("Fail to fill feature set, due to:", err)
+	}
+
+	opts := SearchOptions{
+		Threshold:      -1,
+		Limit:          5,
+		IDs:            []FeatureID{features[2].ID, features[7].ID},
+		IncludeVectors: true,
+		Timeout:        time.Minute,
+	}
+	ret, err := set.SearchWithOptions(context.Background(), opts, features[0].Value, features[7].Value)
+	if err != nil || len(ret) != 2 || len(ret[0]) != 2 || len(ret[1]) != 2 {
+		t.Fatal("Fail to search with options, ret:", ret, "err:", err)
+	}
+	if ret[1][0].ID != features[7].ID || string(ret[1][0].Value) != string(features[7].Value) {
+		t.Fatal("Fail to search with options got wrong target, ret:", ret)
+	}
+	for _, result := range ret[0] {
+		if result.ID != features[2].ID && result.ID != features[7].ID {
+			t.Fatal("Search result should be filtered by ids, ret:", ret)
+		}
+	}
+}
+
+func TestSplitSearch(t *testing.T) {
+	if err := cache.NewSet("split_search", 8, 4, 2, MetricDefault, SetQuota{}); err != nil {
+		t.Fatal("Fail to init feature set, due to:", err)
+	}
+	defer cache.DestroySet("split_search")
+	set, _ := cache.GetSet("split_search")
+
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	features := randomFeatures(r, 7, 8)
+	if err := set.Add(features...); err != nil {
+		t.Fatal("Fail to fill feature set, due to:", err)
+	}
+	var targets []FeatureValue
+	for _, feature := range features {
+		targets = append(targets, feature.Value)
+	}
+
+	if _, err := set.SearchWithOptions(context.Background(), SearchOptions{Limit: 1, Strict: true}, targets...); err != ErrOutOfBatch {
+		t.Fatal("Strict search should fail with out of batch, err:", err)
+	}
+	// norms of L2 are split with targets
+	for _, concurrency := range []int{0, 3} {
+		opts := SearchOptions{Threshold: -1, Limit: 1, Metric: MetricL2, Concurrency: concurrency}
+		ret, err := set.SearchWithOptions(context.Background(), opts, targets...)
+		if err != nil || len(ret) != len(features) {
+			t.Fatal("Fail to split search, ret:", ret, "err:", err)
+		}
+		for i, feature := range features {
+			if len(ret[i]) != 1 || ret[i][0].ID != feature.ID {
+				t.Fatal("Split search got wrong target at", i, "ret:", ret[i])
+			}
+		}
+	}
+	if ret, err := set.Search(0.99, 1, targets...); err != nil || len(ret) != len(features) || ret[6][0].ID != features[6].ID {
+		t.Fatal("Fail to split search, ret:", ret, "err:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := set.SearchContext(ctx, 0, 1, targets...); err != context.Canceled {
+		t.Fatal("Split search should be canceled, err:", err)
+	}
+}
+
+func TestRangeSearch(t *testing.T) {
+	const dims = 8
+	cache, _ := NewCache(newTestDevice(), 4, 16*dims*4)
+	if err := cache.NewSet("range_search", dims, 4, 2, MetricDefault, SetQuota{}); err != nil {
+		t.Fatal("Fail to init feature set, due to:", err)
+	}
+	set, _ := cache.GetSet("range_search")
+
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	features := randomFeatures(r, 40, dims)
+	if err := set.Add(features...); err != nil {
+		t.Fatal("Fail to fill feature set, due to:", err)
+	}
+	if _, err := set.Delete(features[3].ID); err != nil {
+		t.Fatal("Fail to delete feature, due to:", err)
+	}
+
+	targets := []FeatureValue{features[0].Value, features[20].Value, features[39].Value}
+	ret, err := set.RangeSearch(0.2, targets...)
+	if err != nil || len(ret) != len(targets) {
+		t.Fatal("Fail to range search, ret:", ret, "err:", err)
+	}
+	for i, target := range targets {
+		t1, _ := TFloat32Value(target)
+		// scores close to threshold may be either side
+		expect, allowed := make(map[FeatureID]bool, 0), make(map[FeatureID]bool, 0)
+		for j, feature := range features {
+			f, _ := TFloat32Value(feature.Value)
+			var score float32
+			for k := range f {
+				score += f[k] * t1[k]
+			}
+			if j != 3 && score >= 0.2-1e-5 {
+				allowed[feature.ID] = true
+			}
+			if j != 3 && score >= 0.2+1e-5 {
+				expect[feature.ID] = true
+			}
+		}
+		found := 0
+		for j, result := range ret[i] {
+			if !allowed[result.ID] || (j > 0 && result.Score > ret[i][j-1].Score) {
+				t.Fatal("Wrong range search result of target", i, "ret:", ret[i])
+			}
+			if expect[result.ID] {
+				found++
+			}
+		}
+		if found != len(expect) {
+			t.Fatal("Wrong range search number of target", i, "got:", found, "expect:", len(expect))
+		}
+	}
+
+	// options still apply, limit is ignored
+	opts := SearchOptions{Threshold: -1, Limit: 1, IDs: []FeatureID{features[1].ID, features[30].ID}}
+	ret, err = set.RangeSearchWithOptions(context.Background(), opts, targets[0])
+	if err != nil || len(ret[0]) != 2 {
+		t.Fatal("Fail to range search with options, ret:", ret, "err:", err)
+	}
+}
+
+func TestSearchByID(t *testing.T) {
+	if err := cache.NewSet("search_by_id", 8, 4, 2, MetricCosine, SetQuota{}); err != nil {
+		t.Fatal("Fail to init feature set, due to:", err)
+	}
+	defer cache.DestroySet("search_by_id")
+	set, _ := cache.GetSet("search_by_id")
+
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	features := randomFeatures(r, 10, 8)
+	// a near duplicate of features[0]
+	features[9].Value = features[0].Value
+	if err := set.Add(features...); err != nil {
+		t.Fatal("Fail to fill feature set, due to:", err)
+	}
+
+	ret, err := set.SearchByID(context.Background(), SearchOptions{Threshold: 0.99, Limit: 2}, features[0].ID, features[5].ID)
+	if err != nil || len(ret) != 2 || len(ret[0]) != 2 || len(ret[1]) != 1 || ret[1][0].ID != features[5].ID {
+		t.Fatal("Fail to search by id, ret:", ret, "err:", err)
+	}
+
+	opts := SearchOptions{Threshold: -1, Limit: 3, ExcludeSelf: true}
+	ret, err = set.SearchByID(context.Background(), opts, features[0].ID, features[5].ID)
+	if err != nil || len(ret[0]) != 3 || len(ret[1]) != 3 || ret[0][0].ID != features[9].ID {
+		t.Fatal("Fail to search by id excluding self, ret:", ret, "err:", err)
+	}
+	for i, id := range []FeatureID{features[0].ID, features[5].ID} {
+		for _, result := range ret[i] {
+			if result.ID == id {
+				t.Fatal("Target itself should be excluded, ret:", ret[i])
+			}
+		}
+	}
+
+	if _, err = set.SearchByID(context.Background(), opts, features[1].ID, "missing"); err == nil {
+		t.Fatal("Search by missing id should fail")
+	} else if e, ok := err.(*FeatureNotFoundError); !ok || len(e.IDs) != 1 || e.IDs[0] != "missing" {
+		t.Fatal("Search by missing id should fail with not found, err:", err)
+	}
+}
+
+func TestSearchMetric(t *testing.T) {
+	var (
+		f1, f2, target Feature
+		ret            [][]FeatureSearchResult
+		err            error
+	)
+	f1.ID, f2.ID = FeatureID(GetRandomString(12)), FeatureID(GetRandomString(12))
+	f1.Value, _ = TFeatureValue([]float32{1.0, 0.0})
+	f2.Value, _ = TFeatureValue([]float32{10.0, 0.5})
+	target.Value, _ = TFeatureValue([]float32{2.0, 0.0})
+
+	for _, metric := range []Metric{MetricInnerProduct, MetricCosine, MetricL2} {
+		name := fmt.Sprint("search_metric_", metric)
+		if err = cache.NewSet(name, 2, 4, 1, metric, SetQuota{}); err != nil {
+			t.Fatal("Fail to init feature set, due to:", err)
+		}
+		set, _ := cache.GetSet(name)
+		if err = set.Add(f1, f2); err != nil {
+			t.Fatal("Fail to fill feature set, due to:", err)
+		}
+		if ret, err = set.Search(-1000, 2, target.Value); err != nil || len(ret[0]) != 2 {
+			t.Fatal("Fail to search feature, ret:", ret, "err:", err)
+		}
+		switch metric {
+		case MetricInnerProduct:
+			if ret[0][0].ID != f2.ID || ret[0][0].Score < 19.999 || ret[0][1].Score > 2.001 {
+				t.Fatal("Fail to search by inner product, ret:", ret)
+			}
+		case MetricCosine:
+			if ret[0][0].ID != f1.ID || ret[0][0].Score < 0.999 || ret[0][1].Score > 0.999 {
+				t.Fatal("Fail to search by cosine, ret:", ret)
+			}
+		case MetricL2:
+			if ret[0][0].ID != f1.ID || ret[0][0].Score < -1.001 || ret[0][1].Score > -64.249 {
+				t.Fatal("Fail to search by l2, ret:", ret)
+			}
+		}
+		cache.DestroySet(name)
+	}
+}
+
+func TestFeatureAttributes(t *testing.T) {
+	if err := cache.NewSet("feature_attributes", 8, 4, 2, MetricDefault, SetQuota{}); err != nil {
+		t.Fatal("Fail to init feature set, due to:", err)
+	}
+	defer cache.DestroySet("feature_attributes")
+	set, _ := cache.GetSet("feature_attributes")
+
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	features := randomFeatures(r, 3, 8)
+	now := time.Now()
+	features[0].Attributes = Attributes{"camera_id": 3, "tenant": "a", "timestamp": now}
+	if err := set.Add(features...); err != nil {
+		t.Fatal("Fail to fill feature set, due to:", err)
+	}
+	invalid := randomFeatures(r, 1, 8)
+	invalid[0].Attributes = Attributes{"score": 0.5}
+	if err := set.Add(invalid...); err != ErrInvalidAttribute {
+		t.Fatal("Fail to reject invalid attributes, err:", err)
+	}
+
+	ret, err := set.Search(0.99, 1, features[0].Value)
+	if err != nil || len(ret[0]) != 1 {
+		t.Fatal("Fail to search feature, ret:", ret, "err:", err)
+	}
+	attrs := ret[0][0].Attributes
+	if attrs["camera_id"] != int64(3) || attrs["tenant"] != "a" || !attrs["timestamp"].(time.Time).Equal(now) {
+		t.Fatal("Fail to get attributes in search result, ret:", ret)
+	}
+
+	read, err := set.Read(features[0].ID, features[1].ID)
+	if err != nil || read[0].Attributes["tenant"] != "a" || read[1].Attributes != nil {
+		t.Fatal("Fail to read attributes, features:", read, "err:", err)
+	}
+}
+
+func TestFilteredSearch(t *testing.T) {
+	if err := cache.NewSet("filtered_search", 8, 4, 1, MetricDefault, SetQuota{}); err != nil {
+		t.Fatal("Fail to init feature set, due to:", err)
+	}
+	defer cache.DestroySet("filtered_search")
+	set, _ := cache.GetSet("filtered_search")
+
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	features := randomFeatures(r, 20, 8)
+	now := time.Now()
+	for i := range features {
+		features[i].Attributes = Attributes{
+			"camera_id": i % 10,
+			"timestamp": now.Add(-time.Duration(i) * time.Hour),
+		}
+	}
+	if err := set.Add(features...); err != nil {
+		t.Fatal("Fail to fill feature set, due to:", err)
+	}
+
+	// the best match is filtered out, still got the best one in the rest
+	opts := SearchOptions{
+		Threshold: -1,
+		Limit:     1,
+		Filter: And(
+			In("camera_id", 3, 7),
+			Range("timestamp", now.Add(-10*time.Hour), nil),
+		),
+	}
+	ret, err := set.SearchWithOptions(context.Background(), opts, features[0].Value)
+	if err != nil || len(ret[0]) != 1 {
+		t.Fatal("Fail to search with filter, ret:", ret, "err:", err)
+	}
+	if ret[0][0].ID != features[3].ID && ret[0][0].ID != features[7].ID {
+		t.Fatal("Fail to search with filter got wrong target, ret:", ret)
+	}
+
+	opts.Limit = 5
+	opts.Filter = Not(Exists("camera_id"))
+	if ret, err = set.SearchWithOptions(context.Background(), opts, features[0].Value); err != nil || len(ret[0]) != 0 {
+		t.Fatal("Fail to search with filter, ret:", ret, "err:", err)
+	}
+}
+
 // search 1 in 1000
 func BenchmarkSearch1TO1000(b *testing.B) {
 	r := rand.New(rand.NewSource(time.Now().Unix()))
@@ -156,7 +603,35 @@ func BenchmarkSearch1TO1000(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		if _, err := set.Search(0.0, 1, target); err != nil {
-			b.Fatalf("failed to search, err: ", err)
+			b.Fatalf("failed to search, err: %v", err)
+		}
+	}
+}
+
+func BenchmarkSearchBlocks(b *testing.B) {
+	const (
+		blocks = 8
+		height = 2048
+		batch  = 16
+	)
+	cache, _ := NewCache(newTestDevice(), blocks, height*dims*premision)
+	if err := cache.NewSet("search_blocks", dims, premision, batch, MetricDefault, SetQuota{}); err != nil {
+		b.Fatal("Fail to init feature set, due to:", err)
+	}
+	set, _ := cache.GetSet("search_blocks")
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	features := randomFeatures(r, blocks*height, dims)
+	if err := set.Add(features...); err != nil {
+		b.Fatal("Fail to fill feature set, due to:", err)
+	}
+	var targets []FeatureValue
+	for i := 0; i < batch; i++ {
+		targets = append(targets, features[i*97].Value)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := set.Search(0.0, 10, targets...); err != nil {
+			b.Fatalf("failed to search, err: %v", err)
 		}
 	}
 }
@@ -1,99 +1,101 @@
-// +build cublas
-
 package goFeature
 
 import (
 	"context"
+	"sort"
 	"sync"
-
-	"github.com/unixpickle/cuda"
-	"github.com/unixpickle/cuda/cublas"
+	"sync/atomic"
+	"time"
 )
 
-type SearchJob struct {
-	Block
-	Features []FeatureValue
-	Batch    int
-	Limit    int
-	RetChan  chan struct {
-		Result [][]FeatureSearchResult
-		Err    error
-	}
-}
-
 type FeatureSet struct {
-	*cuda.Context
-	*cublas.Handle
+	Kernel
 	Name            string
 	Dimension       int
 	BlockFeatureNum int
 	Precision       int
 	Batch           int
+	Metric          Metric
+	Quota           SetQuota
+	Created         time.Time
+	WAL             *WAL
 	Blocks          []Block
+	Index           map[FeatureID]Block
+	Mutex           sync.RWMutex
 	Cache           Cache
-	InputBuffer     []Buffer
-	OutputBuffer    []Buffer
-	SearchQueue     chan SearchJob
-	SearchLock      sync.Mutex
-}
-
-func (s *FeatureSet) doSearch(ctx context.Context, inputBuffer, outputBuffer Buffer) {
+	Device          Device
 
-	var (
-		ret struct {
-			Result [][]FeatureSearchResult
-			Err    error
-		}
-	)
+	// internal
+	compactStop  chan struct{}
+	coalescer    *coalescer
+	inputBuffers chan Buffer
+	inputNum     int64
+	searching    int64
+	// ids of s.Index in order, for Scan
+	ids idIndex
+}
 
-	for {
-		select {
-		case job := <-s.SearchQueue:
-
-			var (
-				target FeatureValue
-				err    error
-			)
-			target, err = FeatureValueTranspose1D(s.Precision, job.Features...)
-			if err != nil {
-				ret.Err = err
-				job.RetChan <- ret
-			}
+func (s *FeatureSet) Add(feautres ...Feature) (err error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
 
-			if err = inputBuffer.Write(target); err != nil {
-				ret.Err = ErrWriteInputBuffer
-				job.RetChan <- ret
-			}
+	if feautres, err = s.prepare(feautres...); err != nil {
+		return
+	}
+	return s.add(feautres...)
+}
 
-			ret.Result, ret.Err = job.Block.Search(inputBuffer, outputBuffer, job.Batch, job.Limit)
-			job.RetChan <- ret
-		case <-ctx.Done():
-			return
+// add :
+//	add features already prepared, s.Mutex should be held
+func (s *FeatureSet) add(feautres ...Feature) (err error) {
+	var duplicated []FeatureID
+	ids := make(map[FeatureID]bool, len(feautres))
+	for _, feature := range feautres {
+		if _, exist := s.Index[feature.ID]; exist || ids[feature.ID] {
+			duplicated = append(duplicated, feature.ID)
 		}
+		ids[feature.ID] = true
+	}
+	if len(duplicated) > 0 {
+		return &DuplicateFeatureError{IDs: duplicated}
 	}
 
-}
-
-func (s *FeatureSet) Add(feautres ...Feature) (err error) {
 	var empty int
 
 	for _, block := range s.Blocks {
 		empty += block.Margin()
 	}
 
+	var blocks []Block
 	if len(feautres) > empty {
 		remain := len(feautres) - empty
 		blockLength := s.Cache.GetBlockSize() / (s.Dimension * s.Precision)
 		blockNum := (remain + blockLength - 1) / blockLength
-		var blocks []Block
-		if blocks, err = s.Cache.GetEmptyBlock(blockNum); err != nil {
+		if blocks, err = s.accquireBlocks(blockNum); err != nil {
 			return
 		}
-		for _, block := range blocks {
-			block.Accquire(s.Handle, s.Name, s.Dimension, s.Precision, s.Batch, s.doSearch)
+	}
+	if s.WAL != nil {
+		if err = s.WAL.logAdd(s.Name, feautres...); err != nil {
+			s.releaseBlocks(blocks)
+			return
+		}
+	}
+	err = s.insert(feautres...)
+	// features inserted before any failure are in index
+	inserted := make([]FeatureID, 0, len(feautres))
+	for _, feature := range feautres {
+		if _, exist := s.Index[feature.ID]; exist {
+			inserted = append(inserted, feature.ID)
 		}
-		s.Blocks = append(s.Blocks, blocks...)
 	}
+	s.ids.Insert(inserted...)
+	return
+}
+
+// insert :
+//	insert features into the blocks with margin in order, s.Mutex should be held
+func (s *FeatureSet) insert(feautres ...Feature) (err error) {
 	offset := 0
 	remain := len(feautres)
 	for _, block := range s.Blocks {
@@ -105,6 +107,9 @@ func (s *FeatureSet) Add(feautres ...Feature) (err error) {
 			if err = block.Insert(feautres[offset:(offset + length)]...); err != nil {
 				return
 			}
+			for _, feature := range feautres[offset:(offset + length)] {
+				s.Index[feature.ID] = block
+			}
 			offset += length
 			remain -= length
 		}
@@ -115,45 +120,421 @@ func (s *FeatureSet) Add(feautres ...Feature) (err error) {
 	return
 }
 
+// accquireBlocks :
+//	accquire empty blocks from cache, s.Mutex should be held
+func (s *FeatureSet) accquireBlocks(blockNum int) (blocks []Block, err error) {
+	blocks, err = s.Cache.AccquireBlocks(s.Name, blockNum, func(block Block) error {
+		return block.Accquire(s.Kernel, s.Name, s.Dimension, s.Precision, s.Batch)
+	})
+	if err != nil {
+		return
+	}
+	s.Blocks = append(s.Blocks, blocks...)
+	return
+}
+
+// releaseBlocks :
+//	release the empty blocks just accquired by accquireBlocks, s.Mutex should be held
+func (s *FeatureSet) releaseBlocks(blocks []Block) {
+	if len(blocks) == 0 {
+		return
+	}
+	s.Blocks = s.Blocks[:len(s.Blocks)-len(blocks)]
+	for _, block := range blocks {
+		block.Release()
+	}
+}
+
+// load :
+//	load block snapshot into set, into a new block as it was if sameLayout, otherwise add features again
+//	the stored values are prepared already, they are added as they are
+func (s *FeatureSet) load(snapshot BlockSnapshot, sameLayout bool) (err error) {
+	size := s.Dimension * s.Precision
+	if len(snapshot.IDs) != snapshot.NextIndex || len(snapshot.Attrs) != snapshot.NextIndex ||
+		len(snapshot.Value) != snapshot.NextIndex*size {
+		return ErrInvalidSnapshot
+	}
+	var features []Feature
+	for index, id := range snapshot.IDs {
+		if id == "" {
+			continue
+		}
+		features = append(features, Feature{
+			ID:         id,
+			Value:      snapshot.Value[index*size : (index+1)*size],
+			Attributes: snapshot.Attrs[index],
+		})
+	}
+	if len(features) == 0 {
+		return
+	}
+
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	if !sameLayout {
+		return s.add(features...)
+	}
+	for _, id := range snapshot.IDs {
+		if _, exist := s.Index[id]; exist {
+			return &DuplicateFeatureError{IDs: []FeatureID{id}}
+		}
+	}
+	blocks, err := s.accquireBlocks(1)
+	if err != nil {
+		return
+	}
+	if err = blocks[0].Load(snapshot); err != nil {
+		return
+	}
+	ids := make([]FeatureID, 0, len(features))
+	for _, feature := range features {
+		s.Index[feature.ID] = blocks[0]
+		ids = append(ids, feature.ID)
+	}
+	s.ids.Insert(ids...)
+	return
+}
+
 func (s *FeatureSet) Search(threshold FeatureScore, limit int, features ...FeatureValue) (ret [][]FeatureSearchResult, err error) {
-	batch := len(features)
-	if batch > s.Batch {
+	return s.SearchContext(context.Background(), threshold, limit, features...)
+}
+
+// SearchContext :
+//	search N feature(s) in set, return ctx.Err() once ctx is done
+//	blocks not searched yet are skipped after ctx is done
+func (s *FeatureSet) SearchContext(ctx context.Context, threshold FeatureScore, limit int, features ...FeatureValue) (ret [][]FeatureSearchResult, err error) {
+	return s.SearchWithOptions(ctx, SearchOptions{Threshold: threshold, Limit: limit}, features...)
+}
+
+// RangeSearch :
+//	search all the features with score no less than threshold for N feature(s), in descending order of score
+func (s *FeatureSet) RangeSearch(threshold FeatureScore, features ...FeatureValue) (ret [][]FeatureSearchResult, err error) {
+	return s.RangeSearchWithOptions(context.Background(), SearchOptions{Threshold: threshold}, features...)
+}
+
+// RangeSearchWithOptions :
+//	range search with options, threshold is applied while scanning scores in blocks, and opts.Limit is ignored
+func (s *FeatureSet) RangeSearchWithOptions(ctx context.Context, opts SearchOptions, features ...FeatureValue) (ret [][]FeatureSearchResult, err error) {
+	opts.Limit, opts.unlimited = 0, true
+	return s.SearchWithOptions(ctx, opts, features...)
+}
+
+// SearchByID :
+//	search N stored feature(s) by id, the stored vectors are used as targets
+//	FeatureNotFoundError is returned if any id is missing
+func (s *FeatureSet) SearchByID(ctx context.Context, opts SearchOptions, ids ...FeatureID) (ret [][]FeatureSearchResult, err error) {
+	features, err := s.Read(ids...)
+	if err != nil {
+		return
+	}
+	targets := make([]FeatureValue, len(features))
+	for i, feature := range features {
+		targets[i] = feature.Value
+	}
+	limit := opts.Limit
+	if opts.ExcludeSelf {
+		// one more result for the target itself
+		opts.Limit++
+	}
+	if ret, err = s.SearchWithOptions(ctx, opts, targets...); err != nil || !opts.ExcludeSelf {
+		return
+	}
+	for i, results := range ret {
+		filtered := results[:0]
+		for _, result := range results {
+			if result.ID != ids[i] {
+				filtered = append(filtered, result)
+			}
+		}
+		if len(filtered) > limit {
+			filtered = filtered[:limit]
+		}
+		ret[i] = filtered
+	}
+	return
+}
+
+// SearchWithOptions :
+//	search N feature(s) in set with options, features more than the batch are split into chunks unless opts.Strict
+func (s *FeatureSet) SearchWithOptions(ctx context.Context, opts SearchOptions, features ...FeatureValue) (ret [][]FeatureSearchResult, err error) {
+	switch opts.Metric {
+	case MetricDefault:
+		opts.Metric = s.Metric
+	case MetricInnerProduct, MetricCosine, MetricL2:
+	default:
+		return nil, ErrInvalidMetric
+	}
+	switch opts.Metric {
+	case MetricCosine:
+		if features, err = NoramlizeFeatureValues(features...); err != nil {
+			return
+		}
+	case MetricL2:
+		opts.norms = make([]float32, len(features))
+		for i, feature := range features {
+			opts.norms[i] = squareNorm(feature)
+		}
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if len(features) <= s.Batch {
+		return s.searchBatch(ctx, opts, features...)
+	}
+	if opts.Strict {
 		return nil, ErrOutOfBatch
 	}
+	return s.searchChunks(ctx, opts, features...)
+}
+
+// searchChunks :
+//	split targets into chunks of the set batch, search opts.Concurrency chunks at a time,
+//	and return results in the order of targets
+func (s *FeatureSet) searchChunks(ctx context.Context, opts SearchOptions, features ...FeatureValue) (ret [][]FeatureSearchResult, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	var (
+		wg   sync.WaitGroup
+		once sync.Once
+		sem  = make(chan struct{}, concurrency)
+	)
+	ret = make([][]FeatureSearchResult, len(features))
+dispatch:
+	for start := 0; start < len(features); start += s.Batch {
+		end := start + s.Batch
+		if end > len(features) {
+			end = len(features)
+		}
+		chunk := opts
+		if opts.norms != nil {
+			chunk.norms = opts.norms[start:end]
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break dispatch
+		}
+		wg.Add(1)
+		go func(start, end int, chunk SearchOptions) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results, e := s.searchBatch(ctx, chunk, features[start:end]...)
+			if e != nil {
+				// stop the other chunks on the first error
+				once.Do(func() {
+					err = e
+					cancel()
+				})
+				return
+			}
+			copy(ret[start:end], results)
+		}(start, end, chunk)
+	}
+	wg.Wait()
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// searchBatch :
+//	search targets no more than the set batch, targets are prepared for the metric of opts
+func (s *FeatureSet) searchBatch(ctx context.Context, opts SearchOptions, features ...FeatureValue) (ret [][]FeatureSearchResult, err error) {
+	batch := len(features)
+	var results [][]FeatureSearchResult
+	if batch == 1 {
+		var (
+			result []FeatureSearchResult
+			ok     bool
+		)
+		if result, ok, err = s.coalesce(ctx, opts, features[0]); ok {
+			results = [][]FeatureSearchResult{result}
+		}
+	}
+	if results == nil && err == nil {
+		results, err = s.searchBlocks(ctx, batch, opts, features...)
+	}
+	if err != nil {
+		return
+	}
+	for _, result := range results {
+		if opts.unlimited {
+			sort.SliceStable(result, func(i, j int) bool { return result[i].Score > result[j].Score })
+		} else {
+			result = TopKFeatureResult(result, opts.Limit)
+		}
+		ret = append(ret, result)
+	}
+	if opts.IncludeVectors {
+		err = s.fillVectors(ret)
+	}
+	return
+}
+
+// searchBlocks :
+//	search features in all the blocks, results are filtered by threshold in blocks, and merged to top N
+//	of opts.Limit as soon as each block is done
+//	the features are transposed and uploaded once, and shared by the blocks searched concurrently
+//	blocks are not changed by add, delete or compaction during search
+func (s *FeatureSet) searchBlocks(ctx context.Context, batch int, opts SearchOptions, features ...FeatureValue) (results [][]FeatureSearchResult, err error) {
+	target, err := FeatureValueTranspose1D(s.Precision, features...)
+	if err != nil {
+		return
+	}
+	input, err := s.getInputBuffer()
+	if err != nil {
+		return
+	}
+	if err = input.Write(target); err != nil {
+		s.putInputBuffer(input)
+		return nil, ErrWriteInputBuffer
+	}
 
-	results := make([][]FeatureSearchResult, batch)
+	atomic.AddInt64(&s.searching, 1)
+	s.Mutex.RLock()
+	blocks := s.Blocks
 	retChan := make(chan struct {
 		Result [][]FeatureSearchResult
 		Err    error
-	}, len(s.Blocks))
-	for _, block := range s.Blocks {
-		s.SearchQueue <- SearchJob{
-			Block:    block,
-			Features: features,
-			Batch:    batch,
-			Limit:    limit,
-			RetChan:  retChan,
-		}
-	}
-	for _, _ = range s.Blocks {
-		r := <-retChan
-		if r.Err != nil {
-			return nil, r.Err
-		}
-		for b, r := range r.Result {
-			var rr []FeatureSearchResult
-			for _, r1 := range r {
-				if r1.Score >= threshold {
-					rr = append(rr, r1)
+	}, len(blocks))
+	var wg sync.WaitGroup
+	for _, block := range blocks {
+		wg.Add(1)
+		go func(block Block) {
+			defer wg.Done()
+			var ret struct {
+				Result [][]FeatureSearchResult
+				Err    error
+			}
+			// skip the block if the caller has gone away
+			if ret.Err = ctx.Err(); ret.Err == nil {
+				ret.Result, ret.Err = block.Search(input, batch, opts)
+			}
+			retChan <- ret
+		}(block)
+	}
+	// the input buffer is reused and blocks can be changed after all the blocks are done
+	done := func() {
+		wg.Wait()
+		s.Mutex.RUnlock()
+		s.putInputBuffer(input)
+		atomic.AddInt64(&s.searching, -1)
+	}
+
+	results = make([][]FeatureSearchResult, batch)
+	for range blocks {
+		select {
+		case r := <-retChan:
+			err = r.Err
+			for i, result := range r.Result {
+				if results[i] = append(results[i], result...); !opts.unlimited {
+					results[i] = TopKFeatureResult(results[i], opts.Limit)
 				}
 			}
-			results[b] = append(results[b], rr...)
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			go done()
+			return nil, err
 		}
 	}
-	close(retChan)
-	for _, result := range results {
-		_, features := MaxNFeatureResult(result, limit)
-		ret = append(ret, features)
+	done()
+	return
+}
+
+// getInputBuffer :
+//	get an idle input buffer, or allocate a new one
+func (s *FeatureSet) getInputBuffer() (Buffer, error) {
+	select {
+	case buffer := <-s.inputBuffers:
+		return buffer, nil
+	default:
+	}
+	buffer, err := s.Device.NewBuffer(s.Batch * s.Dimension * s.Precision)
+	if err == nil {
+		atomic.AddInt64(&s.inputNum, 1)
+	}
+	return buffer, err
+}
+
+// putInputBuffer :
+//	keep the input buffer for the next search, or drop it if there are enough idle ones
+func (s *FeatureSet) putInputBuffer(buffer Buffer) {
+	select {
+	case s.inputBuffers <- buffer:
+	default:
+		atomic.AddInt64(&s.inputNum, -1)
+	}
+}
+
+// fillVectors :
+//	fill feature values of search results
+func (s *FeatureSet) fillVectors(ret [][]FeatureSearchResult) error {
+	var ids []FeatureID
+	for _, results := range ret {
+		for _, result := range results {
+			ids = append(ids, result.ID)
+		}
+	}
+	features, err := s.Read(ids...)
+	if _, ok := err.(*FeatureNotFoundError); err != nil && !ok {
+		return err
+	}
+	values := make(map[FeatureID]FeatureValue, len(features))
+	for _, feature := range features {
+		values[feature.ID] = feature.Value
+	}
+	for _, results := range ret {
+		for i := range results {
+			results[i].Value = values[results[i].ID]
+		}
+	}
+	return nil
+}
+
+// prepare :
+//	validate values and attributes, and normalize feature values for cosine set
+//	the origin features are not changed
+func (s *FeatureSet) prepare(features ...Feature) (ret []Feature, err error) {
+	ret = make([]Feature, len(features))
+	for i, feature := range features {
+		// values are packed back to back in block, a short one would overwrite the next
+		if len(feature.Value) != s.Dimension*s.Precision {
+			return nil, ErrMismatchDimension
+		}
+		ret[i] = feature
+		if ret[i].Attributes, err = CopyAttributes(feature.Attributes); err != nil {
+			return nil, err
+		}
+	}
+	if s.Metric != MetricCosine {
+		return
+	}
+	values := make([]FeatureValue, len(features))
+	for i, feature := range features {
+		values[i] = feature.Value
+	}
+	if values, err = NoramlizeFeatureValues(values...); err != nil {
+		return nil, err
+	}
+	for i := range ret {
+		ret[i].Value = values[i]
 	}
 	return
 }
@@ -161,59 +542,387 @@ func (s *FeatureSet) Search(threshold FeatureScore, limit int, features ...Featu
 // Delete :
 // 	delete N feature(s) from set
 func (s *FeatureSet) Delete(ids ...FeatureID) (deleted []FeatureID, err error) {
-	var del []FeatureID
-	for _, block := range s.Blocks {
-		if len(ids) == 0 {
-			break
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	var (
+		del   []FeatureID
+		found []FeatureID
+	)
+	targets := make(map[Block][]FeatureID, 0)
+	for _, id := range ids {
+		if block, exist := s.Index[id]; exist {
+			targets[block] = append(targets[block], id)
+			found = append(found, id)
 		}
-		if del, err = block.Delete(ids...); err != nil {
+	}
+	if s.WAL != nil && len(found) > 0 {
+		if err = s.WAL.logDelete(s.Name, found...); err != nil {
 			return
 		}
-		if len(del) == 0 {
+	}
+	for _, block := range s.Blocks {
+		if _, exist := targets[block]; !exist {
 			continue
 		}
-		var remain []FeatureID
-		remain = append(remain, ids...)
-		ids = make([]FeatureID, 0)
+		if del, err = block.Delete(targets[block]...); err != nil {
+			return
+		}
+		for _, id := range del {
+			delete(s.Index, id)
+		}
+		s.ids.Delete(del...)
 		deleted = append(deleted, del...)
-		for _, id := range remain {
-			flag := false
-			for _, d := range del {
-				if id == d {
-					flag = true
-					break
-				}
+	}
+	return
+}
+
+// Update :
+// 	update N feature(s) in set, features not found are ignored
+func (s *FeatureSet) Update(features ...Feature) (updated []FeatureID, err error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if features, err = s.prepare(features...); err != nil {
+		return
+	}
+	return s.update(features...)
+}
+
+// update :
+//	update features already prepared, s.Mutex should be held
+func (s *FeatureSet) update(features ...Feature) (updated []FeatureID, err error) {
+	var (
+		upd   []FeatureID
+		found []Feature
+	)
+	targets := make(map[Block][]Feature, 0)
+	for _, feature := range features {
+		if block, exist := s.Index[feature.ID]; exist {
+			targets[block] = append(targets[block], feature)
+			found = append(found, feature)
+		}
+	}
+	if s.WAL != nil && len(found) > 0 {
+		if err = s.WAL.logUpdate(s.Name, found...); err != nil {
+			return
+		}
+	}
+	for _, block := range s.Blocks {
+		if _, exist := targets[block]; !exist {
+			continue
+		}
+		if upd, err = block.Update(targets[block]...); err != nil {
+			return
+		}
+		updated = append(updated, upd...)
+	}
+	return
+}
+
+// Upsert :
+// 	update N feature(s) in set, and add the ones not found, atomically
+func (s *FeatureSet) Upsert(features ...Feature) (updated, inserted []FeatureID, err error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if features, err = s.prepare(features...); err != nil {
+		return
+	}
+	return s.upsert(features...)
+}
+
+// upsert :
+//	upsert features already prepared, s.Mutex should be held
+func (s *FeatureSet) upsert(features ...Feature) (updated, inserted []FeatureID, err error) {
+	if updated, err = s.update(features...); err != nil {
+		return
+	}
+	done := make(map[FeatureID]bool, len(updated))
+	for _, id := range updated {
+		done[id] = true
+	}
+	var remain []Feature
+	for _, feature := range features {
+		if !done[feature.ID] {
+			remain = append(remain, feature)
+			inserted = append(inserted, feature.ID)
+		}
+	}
+	if len(remain) == 0 {
+		return
+	}
+	if err = s.add(remain...); err != nil {
+		return updated, nil, err
+	}
+	return
+}
+
+// Compact :
+// 	fill the deleted slots of blocks, then move features out of the blocks with
+//	fewest features while the other blocks can hold them, and release the empty blocks
+func (s *FeatureSet) Compact() (released int, err error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	for _, block := range s.Blocks {
+		if _, err = block.Compact(); err != nil {
+			return
+		}
+	}
+	for len(s.Blocks) > 0 {
+		sort.SliceStable(s.Blocks, func(i, j int) bool { return s.Blocks[i].Size() < s.Blocks[j].Size() })
+		source := s.Blocks[0]
+		margin := 0
+		for _, block := range s.Blocks[1:] {
+			margin += block.Margin()
+		}
+		if source.Size() > margin {
+			break
+		}
+
+		snapshot, err := source.Dump()
+		if err != nil {
+			return released, err
+		}
+		size := s.Dimension * s.Precision
+		var features []Feature
+		for index, id := range snapshot.IDs {
+			if id != "" {
+				features = append(features, Feature{
+					ID:         id,
+					Value:      snapshot.Value[index*size : (index+1)*size],
+					Attributes: snapshot.Attrs[index],
+				})
 			}
-			if !flag {
-				ids = append(ids, id)
+		}
+		s.Blocks = s.Blocks[1:]
+		if err = s.insert(features...); err != nil {
+			s.rollbackInsert(source, features...)
+			s.Blocks = append(s.Blocks, source)
+			return released, err
+		}
+		if err = source.Release(); err != nil {
+			return released, err
+		}
+		released++
+	}
+	return
+}
+
+// rollbackInsert :
+//	delete the copies inserted before insert fails, the features are kept in source, s.Mutex should be held
+func (s *FeatureSet) rollbackInsert(source Block, features ...Feature) {
+	copies := make(map[Block][]FeatureID)
+	for _, feature := range features {
+		if block := s.Index[feature.ID]; block != source {
+			copies[block] = append(copies[block], feature.ID)
+			s.Index[feature.ID] = source
+		}
+	}
+	for block, ids := range copies {
+		block.Delete(ids...)
+	}
+}
+
+// SetCompactPolicy :
+//	compact the set in background when the deleted slots reach the fragmentation of policy
+func (s *FeatureSet) SetCompactPolicy(policy CompactPolicy) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if s.compactStop != nil {
+		close(s.compactStop)
+		s.compactStop = nil
+	}
+	if policy.Interval <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	s.compactStop = stop
+	go func() {
+		ticker := time.NewTicker(policy.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if s.fragmentation() >= policy.Fragmentation {
+					s.Compact()
+				}
+			case <-stop:
+				return
 			}
 		}
+	}()
+}
+
+// fragmentation :
+//	deleted slots / used slots of all the blocks
+func (s *FeatureSet) fragmentation() float64 {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	var live, deleted int
+	for _, block := range s.Blocks {
+		live += block.Size()
+		deleted += block.Deleted()
+	}
+	if live+deleted == 0 {
+		return 0
+	}
+	return float64(deleted) / float64(live+deleted)
+}
+
+// Scan :
+//	walk live features in the order of id, starting after cursor, empty cursor for the first page
+//	features exist during the whole scan are returned exactly once, regardless of concurrent mutations
+//	ids are kept in order by s.ids, so each page costs O(log(N) + limit)
+//	- next: cursor of the next page, empty if no more features
+func (s *FeatureSet) Scan(cursor FeatureID, limit int, withValue bool) (features []Feature, next FeatureID, err error) {
+	if limit <= 0 {
+		return nil, "", ErrInvalidLimit
+	}
+
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	ids := s.ids.After(cursor, limit+1)
+	if len(ids) > limit {
+		ids = ids[:limit]
+		next = ids[limit-1]
+	}
+
+	if !withValue {
+		for _, id := range ids {
+			features = append(features, Feature{ID: id})
+		}
+		return
+	}
+
+	var fs []Feature
+	targets := make(map[Block][]FeatureID, 0)
+	for _, id := range ids {
+		targets[s.Index[id]] = append(targets[s.Index[id]], id)
+	}
+	found := make(map[FeatureID]Feature, len(ids))
+	for block, blockIDs := range targets {
+		if fs, err = block.Read(blockIDs...); err != nil {
+			return nil, "", err
+		}
+		for _, feature := range fs {
+			found[feature.ID] = feature
+		}
+	}
+	for _, id := range ids {
+		features = append(features, found[id])
 	}
 	return
 }
 
-func (s *FeatureSet) Update(features ...Feature) (updated []FeatureID, err error) {
-	// TODO
+// Info :
+//	configuration of the set
+func (s *FeatureSet) Info() SetInfo {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	return SetInfo{
+		Name:      s.Name,
+		Dims:      s.Dimension,
+		Precision: s.Precision,
+		Batch:     s.Batch,
+		Metric:    s.Metric,
+		Features:  len(s.Index),
+		Blocks:    len(s.Blocks),
+		Quota:     s.Quota,
+		Created:   s.Created,
+	}
+}
+
+// Stats :
+//	usage statistics of the set
+func (s *FeatureSet) Stats() (stats SetStats) {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	stats.Blocks = len(s.Blocks)
+	for _, block := range s.Blocks {
+		stats.Capacity += block.Capacity()
+		stats.Features += block.Size()
+		stats.Deleted += block.Deleted()
+		stats.Free += block.Margin()
+	}
+	if used := stats.Features + stats.Deleted; used > 0 {
+		stats.Fragmentation = float64(stats.Deleted) / float64(used)
+	}
+	stats.VectorBytes = stats.Features * s.Dimension * s.Precision
+	stats.ScratchBytes = (stats.Blocks*s.BlockFeatureNum + int(atomic.LoadInt64(&s.inputNum))*s.Dimension) * s.Batch * s.Precision
+	stats.QueueDepth = int(atomic.LoadInt64(&s.searching))
+	if s.coalescer != nil {
+		stats.QueueDepth += len(s.coalescer.Queue)
+	}
 	return
 }
 
 // Destroy :
 // 	destroy the whole feature set and release resource
 func (s *FeatureSet) Destroy() (err error) {
-	s.SearchLock.Lock()
-	defer s.SearchLock.Unlock()
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
 
-	close(s.SearchQueue)
+	if s.compactStop != nil {
+		close(s.compactStop)
+		s.compactStop = nil
+	}
+	if s.coalescer != nil {
+		close(s.coalescer.Stop)
+		s.coalescer = nil
+	}
 
 	for _, block := range s.Blocks {
 		if err = block.Release(); err != nil {
 			return
 		}
 	}
+	s.Blocks = nil
+	s.Index = make(map[FeatureID]Block, 0)
+	s.ids = idIndex{}
 	return
 }
 
-func (s *FeatureSet) Read(ids ...FeatureID) ([]Feature, error) {
-	// TODO
-	return nil, nil
+// Read :
+// 	read N feature(s) from set, in the order of ids
+//	FeatureNotFoundError is returned with the features found if any id is missing
+func (s *FeatureSet) Read(ids ...FeatureID) (features []Feature, err error) {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	var fs []Feature
+	targets := make(map[Block][]FeatureID, 0)
+	for _, id := range ids {
+		if block, exist := s.Index[id]; exist {
+			targets[block] = append(targets[block], id)
+		}
+	}
+	found := make(map[FeatureID]Feature, len(ids))
+	for block, blockIDs := range targets {
+		if fs, err = block.Read(blockIDs...); err != nil {
+			return nil, err
+		}
+		for _, feature := range fs {
+			found[feature.ID] = feature
+		}
+	}
+
+	var missing []FeatureID
+	for _, id := range ids {
+		if feature, exist := found[id]; exist {
+			features = append(features, feature)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		err = &FeatureNotFoundError{IDs: missing}
+	}
+	return
 }
@@ -0,0 +1,350 @@
+package goFeature
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sort"
+	"time"
+)
+
+// snapshot format, little endian
+//
+//	cache: "GFSC" | version uint32 | set number uint32 | set...
+//	set:   "GFSS" | version uint32 | name | dims, precision, batch, metric uint32 |
+//	       min blocks, max blocks uint32 | created time bytes | block size uint64 | block number uint32 | block...
+//	block: next index uint32 | empty number uint32 | empty slot uint32... |
+//	       id... | attributes... | value bytes, [next index]
+//
+// string and bytes are prefixed with length, attributes are number of keys and
+// key | type byte | value for each key
+const (
+	snapshotVersion uint32 = 3
+
+	attrString byte = 1
+	attrInt64  byte = 2
+	attrTime   byte = 3
+
+	// max length of strings and bytes other than block values, so corrupt lengths fail before allocation
+	maxSnapshotString = 1 << 20
+)
+
+var (
+	cacheSnapshotMagic = []byte("GFSC")
+	setSnapshotMagic   = []byte("GFSS")
+)
+
+// snapshotWriter : writer keeps the first error
+type snapshotWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *snapshotWriter) write(data interface{}) {
+	if w.err == nil {
+		w.err = binary.Write(w.w, binary.LittleEndian, data)
+	}
+}
+
+func (w *snapshotWriter) writeBytes(data []byte) {
+	w.write(uint64(len(data)))
+	if w.err == nil {
+		_, w.err = w.w.Write(data)
+	}
+}
+
+func (w *snapshotWriter) writeString(str string) { w.writeBytes([]byte(str)) }
+
+func (w *snapshotWriter) writeAttributes(attrs Attributes) {
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	w.write(uint32(len(keys)))
+	for _, key := range keys {
+		w.writeString(key)
+		switch value := attrs[key].(type) {
+		case string:
+			w.write(attrString)
+			w.writeString(value)
+		case int64:
+			w.write(attrInt64)
+			w.write(value)
+		case time.Time:
+			data, err := value.MarshalBinary()
+			if err != nil && w.err == nil {
+				w.err = err
+			}
+			w.write(attrTime)
+			w.writeBytes(data)
+		default:
+			if w.err == nil {
+				w.err = ErrInvalidAttribute
+			}
+		}
+	}
+}
+
+// snapshotReader : reader keeps the first error
+type snapshotReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *snapshotReader) read(data interface{}) {
+	if r.err == nil {
+		r.err = binary.Read(r.r, binary.LittleEndian, data)
+	}
+}
+
+func (r *snapshotReader) readUint32() int {
+	var value uint32
+	r.read(&value)
+	return int(value)
+}
+
+// readBytes : read bytes no longer than limit, ErrInvalidSnapshot if the length exceeds it
+func (r *snapshotReader) readBytes(limit int) []byte {
+	var length uint64
+	r.read(&length)
+	if r.err != nil {
+		return nil
+	}
+	if length > uint64(limit) {
+		r.err = ErrInvalidSnapshot
+		return nil
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		r.err = err
+		return nil
+	}
+	return data
+}
+
+func (r *snapshotReader) readString() string { return string(r.readBytes(maxSnapshotString)) }
+
+func (r *snapshotReader) readAttributes() (attrs Attributes) {
+	num := r.readUint32()
+	if r.err != nil || num == 0 {
+		return nil
+	}
+	attrs = make(Attributes, num)
+	for i := 0; i < num && r.err == nil; i++ {
+		key := r.readString()
+		var kind byte
+		r.read(&kind)
+		switch kind {
+		case attrString:
+			attrs[key] = r.readString()
+		case attrInt64:
+			var value int64
+			r.read(&value)
+			attrs[key] = value
+		case attrTime:
+			var value time.Time
+			if data := r.readBytes(maxSnapshotString); r.err == nil {
+				r.err = value.UnmarshalBinary(data)
+			}
+			attrs[key] = value
+		default:
+			if r.err == nil {
+				r.err = ErrInvalidSnapshot
+			}
+		}
+	}
+	return
+}
+
+func (r *snapshotReader) readHeader(magic []byte) {
+	header := make([]byte, len(magic))
+	if r.err != nil {
+		return
+	}
+	if _, r.err = io.ReadFull(r.r, header); r.err != nil {
+		return
+	}
+	if string(header) != string(magic) {
+		r.err = ErrInvalidSnapshot
+		return
+	}
+	if version := r.readUint32(); r.err == nil && uint32(version) != snapshotVersion {
+		r.err = ErrSnapshotVersion
+	}
+}
+
+// Snapshot :
+//	write the set config and all the blocks into w
+func (s *FeatureSet) Snapshot(w io.Writer) (err error) {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	buf := bufio.NewWriter(w)
+	writer := &snapshotWriter{w: buf}
+	writer.write(setSnapshotMagic)
+	writer.write(snapshotVersion)
+	writer.writeString(s.Name)
+	writer.write([]uint32{uint32(s.Dimension), uint32(s.Precision), uint32(s.Batch), uint32(s.Metric)})
+	writer.write([]uint32{uint32(s.Quota.MinBlocks), uint32(s.Quota.MaxBlocks)})
+	created, err := s.Created.MarshalBinary()
+	if err != nil {
+		return
+	}
+	writer.writeBytes(created)
+	writer.write(uint64(s.Cache.GetBlockSize()))
+	writer.write(uint32(len(s.Blocks)))
+	for _, block := range s.Blocks {
+		snapshot, err := block.Dump()
+		if err != nil {
+			return err
+		}
+		writer.write(uint32(snapshot.NextIndex))
+		writer.write(uint32(len(snapshot.Empty)))
+		for _, index := range snapshot.Empty {
+			writer.write(uint32(index))
+		}
+		for _, id := range snapshot.IDs {
+			writer.writeString(string(id))
+		}
+		for _, attrs := range snapshot.Attrs {
+			writer.writeAttributes(attrs)
+		}
+		writer.writeBytes(snapshot.Value)
+	}
+	if writer.err != nil {
+		return writer.err
+	}
+	return buf.Flush()
+}
+
+// Snapshot :
+//	write all the sets into w, in the order of set name
+//	the write-ahead log is truncated after the snapshot is written
+func (c *_Cache) Snapshot(w io.Writer) (err error) {
+	c.Mutex.Lock()
+	wal := c.WAL
+	var seq uint64
+	if wal != nil {
+		seq = wal.Seq()
+	}
+	names := make([]string, 0, len(c.Sets))
+	for name := range c.Sets {
+		names = append(names, name)
+	}
+	sets := make([]Set, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		sets = append(sets, c.Sets[name])
+	}
+	c.Mutex.Unlock()
+
+	buf := bufio.NewWriter(w)
+	writer := &snapshotWriter{w: buf}
+	writer.write(cacheSnapshotMagic)
+	writer.write(snapshotVersion)
+	writer.write(uint32(len(sets)))
+	if writer.err != nil {
+		return writer.err
+	}
+	for _, set := range sets {
+		if err = set.Snapshot(buf); err != nil {
+			return
+		}
+	}
+	if err = buf.Flush(); err != nil || wal == nil {
+		return
+	}
+	return wal.Truncate(seq)
+}
+
+// RestoreSet :
+//	restore a set from snapshot, the set should not exist in the cache
+//	blocks are loaded as they were if the block size is the same, otherwise features are added again
+func (c *_Cache) RestoreSet(r io.Reader) (name string, err error) {
+	reader := &snapshotReader{r: r}
+	reader.readHeader(setSnapshotMagic)
+	name = reader.readString()
+	dims, precision, batch, metric := reader.readUint32(), reader.readUint32(), reader.readUint32(), reader.readUint32()
+	quota := SetQuota{MinBlocks: reader.readUint32(), MaxBlocks: reader.readUint32()}
+	var created time.Time
+	if data := reader.readBytes(maxSnapshotString); reader.err == nil {
+		reader.err = created.UnmarshalBinary(data)
+	}
+	var blockSize uint64
+	reader.read(&blockSize)
+	blockNum := reader.readUint32()
+	if reader.err != nil {
+		return "", reader.err
+	}
+	if dims == 0 || precision == 0 {
+		return "", ErrInvalidSnapshot
+	}
+
+	if err = c.NewSet(name, dims, precision, batch, Metric(metric), quota); err != nil {
+		return
+	}
+	set, err := c.GetSet(name)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			c.DestroySet(name)
+		}
+	}()
+	fs := set.(*FeatureSet)
+	fs.Mutex.Lock()
+	fs.Created = created
+	fs.Mutex.Unlock()
+	for i := 0; i < blockNum; i++ {
+		var snapshot BlockSnapshot
+		snapshot.NextIndex = reader.readUint32()
+		emptyNum := reader.readUint32()
+		if reader.err != nil {
+			return name, reader.err
+		}
+		size := dims * precision
+		if uint64(snapshot.NextIndex)*uint64(size) > blockSize || emptyNum > snapshot.NextIndex {
+			return name, ErrInvalidSnapshot
+		}
+		for j := 0; j < emptyNum && reader.err == nil; j++ {
+			snapshot.Empty = append(snapshot.Empty, reader.readUint32())
+		}
+		for j := 0; j < snapshot.NextIndex && reader.err == nil; j++ {
+			snapshot.IDs = append(snapshot.IDs, FeatureID(reader.readString()))
+		}
+		for j := 0; j < snapshot.NextIndex && reader.err == nil; j++ {
+			snapshot.Attrs = append(snapshot.Attrs, reader.readAttributes())
+		}
+		snapshot.Value = reader.readBytes(snapshot.NextIndex * size)
+		if reader.err != nil {
+			return name, reader.err
+		}
+		if err = fs.load(snapshot, int(blockSize) == c.BlockSize); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// RestoreCache :
+//	create a cache on device and restore all the sets from snapshot written by Cache.Snapshot
+func RestoreCache(r io.Reader, device Device, blockNum, blockSize int) (cache *_Cache, err error) {
+	if cache, err = NewCache(device, blockNum, blockSize); err != nil {
+		return
+	}
+	buf := bufio.NewReader(r)
+	reader := &snapshotReader{r: buf}
+	reader.readHeader(cacheSnapshotMagic)
+	setNum := reader.readUint32()
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	for i := 0; i < setNum; i++ {
+		if _, err = cache.RestoreSet(buf); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
@@ -0,0 +1,178 @@
+package goFeature
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	const (
+		dims      = 8
+		blockSize = 16 * dims * 4
+	)
+	src, err := NewCache(newTestDevice(), 4, blockSize)
+	if err != nil {
+		t.Fatal("Fail to init cache, due to:", err)
+	}
+	if err = src.NewSet("snapshot", dims, 4, 2, MetricCosine, SetQuota{}); err != nil {
+		t.Fatal("Fail to init feature set, due to:", err)
+	}
+	s, err := src.GetSet("snapshot")
+	if err != nil {
+		t.Fatal("Fail to get feature set, due to:", err)
+	}
+
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	features := randomFeatures(r, 40, dims)
+	now := time.Now()
+	for i := range features {
+		features[i].Attributes = Attributes{"index": i, "tenant": "a", "timestamp": now}
+	}
+	if err = s.Add(features...); err != nil {
+		t.Fatal("Fail to fill feature set, due to:", err)
+	}
+	if _, err = s.Delete(features[1].ID, features[20].ID); err != nil {
+		t.Fatal("Fail to delete features, due to:", err)
+	}
+
+	stored, err := s.Read(features[39].ID)
+	if err != nil {
+		t.Fatal("Fail to read feature, due to:", err)
+	}
+
+	var buf bytes.Buffer
+	if err = src.Snapshot(&buf); err != nil {
+		t.Fatal("Fail to snapshot cache, due to:", err)
+	}
+	data := buf.Bytes()
+
+	// same block size with more blocks, and a larger block size
+	for _, size := range []int{blockSize, blockSize * 4} {
+		dst, err := RestoreCache(bytes.NewReader(data), newTestDevice(), 6, size)
+		if err != nil {
+			t.Fatal("Fail to restore cache, due to:", err)
+		}
+		restored, err := dst.GetSet("snapshot")
+		if err != nil {
+			t.Fatal("Fail to get restored set, due to:", err)
+		}
+		ret, err := restored.Read(features[0].ID, features[1].ID, features[39].ID)
+		if _, ok := err.(*FeatureNotFoundError); !ok || len(ret) != 2 {
+			t.Fatal("Fail to read restored features, ret:", ret, "err:", err)
+		}
+		if string(ret[1].Value) != string(stored[0].Value) || ret[1].Attributes["index"] != int64(39) ||
+			!ret[1].Attributes["timestamp"].(time.Time).Equal(now) {
+			t.Fatal("Fail to restore feature content, ret:", ret[1])
+		}
+		search, err := restored.Search(0.99, 1, features[5].Value)
+		if err != nil || len(search[0]) != 1 || search[0][0].ID != features[5].ID {
+			t.Fatal("Fail to search restored set, ret:", search, "err:", err)
+		}
+		if info := restored.Info(); !info.Created.Equal(s.Info().Created) {
+			t.Fatal("Fail to restore creation time, got:", info.Created, "expect:", s.Info().Created)
+		}
+		if err = restored.Add(features[1]); err != nil {
+			t.Fatal("Fail to add feature into restored set, due to:", err)
+		}
+	}
+
+	if _, err = RestoreCache(bytes.NewReader(data[:len(data)/2]), newTestDevice(), 6, blockSize); err == nil {
+		t.Fatal("Restore from truncated snapshot should fail")
+	}
+}
+
+func TestSnapshotRestoreCosine(t *testing.T) {
+	// normalizing again changes the bytes of some vectors at 512 dims, but rarely at small dims
+	size := 16 * dims * premision
+	src, err := NewCache(newTestDevice(), 4, size)
+	if err != nil {
+		t.Fatal("Fail to init cache, due to:", err)
+	}
+	if err = src.NewSet("snapshot_cosine", dims, premision, 2, MetricCosine, SetQuota{}); err != nil {
+		t.Fatal("Fail to init feature set, due to:", err)
+	}
+	s, err := src.GetSet("snapshot_cosine")
+	if err != nil {
+		t.Fatal("Fail to get feature set, due to:", err)
+	}
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	features := randomFeatures(r, 40, dims)
+	if err = s.Add(features...); err != nil {
+		t.Fatal("Fail to fill feature set, due to:", err)
+	}
+	ids := make([]FeatureID, len(features))
+	for i, feature := range features {
+		ids[i] = feature.ID
+	}
+	stored, err := s.Read(ids...)
+	if err != nil {
+		t.Fatal("Fail to read features, due to:", err)
+	}
+	var buf bytes.Buffer
+	if err = src.Snapshot(&buf); err != nil {
+		t.Fatal("Fail to snapshot cache, due to:", err)
+	}
+
+	// features are added again into larger blocks, the normalized values should be kept as they are
+	dst, err := RestoreCache(&buf, newTestDevice(), 2, size*4)
+	if err != nil {
+		t.Fatal("Fail to restore cache, due to:", err)
+	}
+	restored, err := dst.GetSet("snapshot_cosine")
+	if err != nil {
+		t.Fatal("Fail to get restored set, due to:", err)
+	}
+	ret, err := restored.Read(ids...)
+	if err != nil {
+		t.Fatal("Fail to read restored features, due to:", err)
+	}
+	for i := range stored {
+		if !bytes.Equal(ret[i].Value, stored[i].Value) {
+			t.Fatalf("Value of feature %s is changed by restore", stored[i].ID)
+		}
+	}
+}
+
+func TestRestoreCorruptSnapshot(t *testing.T) {
+	c, err := NewCache(newTestDevice(), 4, 16*8*4)
+	if err != nil {
+		t.Fatal("Fail to init cache, due to:", err)
+	}
+	// name length far beyond the data
+	var buf bytes.Buffer
+	writer := &snapshotWriter{w: &buf}
+	writer.write(setSnapshotMagic)
+	writer.write(snapshotVersion)
+	writer.write(uint64(1 << 62))
+	if _, err = c.RestoreSet(&buf); err != ErrInvalidSnapshot {
+		t.Fatal("Restore should fail with invalid snapshot, err:", err)
+	}
+
+	// block larger than the block size
+	buf.Reset()
+	writer.write(setSnapshotMagic)
+	writer.write(snapshotVersion)
+	writer.writeString("corrupt")
+	writer.write([]uint32{8, 4, 2, uint32(MetricInnerProduct), 0, 0})
+	created, _ := time.Now().MarshalBinary()
+	writer.writeBytes(created)
+	writer.write(uint64(16 * 8 * 4))
+	writer.write([]uint32{1, 1 << 30, 0})
+	if _, err = c.RestoreSet(&buf); err != ErrInvalidSnapshot {
+		t.Fatal("Restore should fail with invalid snapshot, err:", err)
+	}
+	if names := c.ListSets(); len(names) != 0 {
+		t.Fatal("Set of corrupt snapshot should be destroyed, got:", names)
+	}
+
+	// only the current version is supported
+	buf.Reset()
+	writer.write(setSnapshotMagic)
+	writer.write(snapshotVersion - 1)
+	writer.writeString("old")
+	if _, err = c.RestoreSet(&buf); err != ErrSnapshotVersion {
+		t.Fatal("Restore should fail with unsupported version, err:", err)
+	}
+}
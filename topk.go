@@ -0,0 +1,186 @@
+package goFeature
+
+import (
+	"sort"
+	"sync"
+)
+
+// ScoreTransform : conversion from product to score, applied before selection
+//	score of feature j and target i = Scale[j] * product + Bias[j] + QueryBias[i]
+type ScoreTransform struct {
+	// [height]
+	Scale []float32
+	// [height], -Inf for features excluded
+	Bias []float32
+	// [batch], zero if empty
+	QueryBias []float32
+}
+
+// Apply : convert products stored as [height][batch] to scores in place
+func (t ScoreTransform) Apply(products []float32, batch, height int) {
+	for j := 0; j < height; j++ {
+		scale, bias := t.Scale[j], t.Bias[j]
+		for i := 0; i < batch; i++ {
+			score := scale*products[j*batch+i] + bias
+			if t.QueryBias != nil {
+				score += t.QueryBias[i]
+			}
+			products[j*batch+i] = score
+		}
+	}
+}
+
+// topKHeap : bounded min-heap of scores, the root is the worst one kept
+type topKHeap struct {
+	Indexes []int
+	Values  []float32
+	Limit   int
+}
+
+// worse : score i is worse than score j, the larger index is worse on tie
+func (h *topKHeap) worse(i, j int) bool {
+	if h.Values[i] != h.Values[j] {
+		return h.Values[i] < h.Values[j]
+	}
+	return h.Indexes[i] > h.Indexes[j]
+}
+
+func (h *topKHeap) swap(i, j int) {
+	h.Indexes[i], h.Indexes[j] = h.Indexes[j], h.Indexes[i]
+	h.Values[i], h.Values[j] = h.Values[j], h.Values[i]
+}
+
+func (h *topKHeap) up(i int) {
+	for i > 0 {
+		parent := (i - 1) / 2
+		if !h.worse(i, parent) {
+			return
+		}
+		h.swap(i, parent)
+		i = parent
+	}
+}
+
+func (h *topKHeap) down(i int) {
+	n := len(h.Values)
+	for {
+		worst, left, right := i, 2*i+1, 2*i+2
+		if left < n && h.worse(left, worst) {
+			worst = left
+		}
+		if right < n && h.worse(right, worst) {
+			worst = right
+		}
+		if worst == i {
+			return
+		}
+		h.swap(i, worst)
+		i = worst
+	}
+}
+
+// Push : keep the score if it is better than the worst one kept
+func (h *topKHeap) Push(index int, value float32) {
+	if len(h.Values) < h.Limit {
+		h.Indexes = append(h.Indexes, index)
+		h.Values = append(h.Values, value)
+		h.up(len(h.Values) - 1)
+		return
+	}
+	root := h.Values[0]
+	if value < root || (value == root && index > h.Indexes[0]) {
+		return
+	}
+	h.Indexes[0], h.Values[0] = index, value
+	h.down(0)
+}
+
+// Sorted : scores kept in descending order, the smaller index first on tie
+func (h *topKHeap) Sorted() ([]int, []float32) {
+	sort.Sort(sort.Reverse(h))
+	return h.Indexes, h.Values
+}
+
+func (h *topKHeap) Len() int           { return len(h.Values) }
+func (h *topKHeap) Less(i, j int) bool { return h.worse(i, j) }
+func (h *topKHeap) Swap(i, j int)      { h.swap(i, j) }
+
+// TopKFloat32 : top N of vector no less than threshold, in descending order
+//	O(len(vector) * log(limit)), NaN is never selected
+func TopKFloat32(vector []float32, limit int, threshold float32) ([]int, []float32) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	h := &topKHeap{Limit: limit}
+	for k, v := range vector {
+		if v >= threshold {
+			h.Push(k, v)
+		}
+	}
+	return h.Sorted()
+}
+
+// BatchTopKFloat32 : top N no less than threshold of each target in scores stored as [height][batch]
+func BatchTopKFloat32(scores []float32, batch, height, limit int, threshold float32) (indexes [][]int, values [][]float32) {
+	indexes = make([][]int, batch)
+	values = make([][]float32, batch)
+	for i := 0; i < batch; i++ {
+		indexes[i], values[i] = topKColumn(scores, batch, height, i, limit, threshold)
+	}
+	return
+}
+
+// ParallelBatchTopKFloat32 : BatchTopKFloat32 with targets selected by N workers
+func ParallelBatchTopKFloat32(scores []float32, batch, height, limit int, threshold float32, workers int) (indexes [][]int, values [][]float32) {
+	if workers > batch {
+		workers = batch
+	}
+	if workers <= 1 {
+		return BatchTopKFloat32(scores, batch, height, limit, threshold)
+	}
+	indexes = make([][]int, batch)
+	values = make([][]float32, batch)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < batch; i += workers {
+				indexes[i], values[i] = topKColumn(scores, batch, height, i, limit, threshold)
+			}
+		}(w)
+	}
+	wg.Wait()
+	return
+}
+
+// topKColumn : top N of target i in scores stored as [height][batch]
+func topKColumn(scores []float32, batch, height, i, limit int, threshold float32) ([]int, []float32) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	h := &topKHeap{Limit: limit}
+	for j := 0; j < height; j++ {
+		if v := scores[j*batch+i]; v >= threshold {
+			h.Push(j, v)
+		}
+	}
+	return h.Sorted()
+}
+
+// TopKFeatureResult : top N search results in descending order of score
+func TopKFeatureResult(results []FeatureSearchResult, limit int) []FeatureSearchResult {
+	if limit <= 0 {
+		return nil
+	}
+	h := &topKHeap{Limit: limit}
+	for k, result := range results {
+		h.Push(k, float32(result.Score))
+	}
+	indexes, _ := h.Sorted()
+	ret := make([]FeatureSearchResult, len(indexes))
+	for i, index := range indexes {
+		ret[i] = results[index]
+	}
+	return ret
+}
@@ -0,0 +1,211 @@
+package goFeature
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func randomScores(r *rand.Rand, n int) []float32 {
+	scores := make([]float32, n)
+	for i := range scores {
+		scores[i] = r.Float32()*2 - 1
+	}
+	return scores
+}
+
+func TestTopKFloat32(t *testing.T) {
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	scores := randomScores(r, 1000)
+	for _, limit := range []int{1, 10, 1000, 2000} {
+		indexes, values := TopKFloat32(scores, limit, float32(math.Inf(-1)))
+		expectIndexes, expectValues := MaxNFloat32(scores, limit)
+		if len(indexes) != len(expectIndexes) {
+			t.Fatal("Wrong top k number, limit:", limit, "got:", len(indexes), "expect:", len(expectIndexes))
+		}
+		// random scores may tie, and MaxNFloat32 does not keep ties in order of index
+		for i := range indexes {
+			if values[i] != expectValues[i] || scores[indexes[i]] != values[i] {
+				t.Fatal("Wrong top k, limit:", limit, "at:", i, "got:", indexes[i], values[i], "expect:", expectIndexes[i], expectValues[i])
+			}
+		}
+	}
+
+	if indexes, _ := TopKFloat32(scores, 0, 0); len(indexes) != 0 {
+		t.Fatal("Top 0 should be empty, got:", indexes)
+	}
+	// threshold, -Inf and NaN are applied during selection, ties are in order of index
+	vector := []float32{0.5, float32(math.NaN()), 0.9, float32(math.Inf(-1)), 0.5, 0.1}
+	indexes, values := TopKFloat32(vector, 10, 0.2)
+	if len(indexes) != 3 || indexes[0] != 2 || indexes[1] != 0 || indexes[2] != 4 || values[2] != 0.5 {
+		t.Fatal("Wrong top k with threshold, got:", indexes, values)
+	}
+}
+
+func TestBatchTopKFloat32(t *testing.T) {
+	const (
+		batch  = 7
+		height = 500
+		limit  = 5
+	)
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	scores := randomScores(r, batch*height)
+	_, expectValues := BatchMaxNFloat32(scores, batch, height, limit)
+	for _, workers := range []int{1, 3, 16} {
+		indexes, values := ParallelBatchTopKFloat32(scores, batch, height, limit, -1, workers)
+		for i := 0; i < batch; i++ {
+			for j := 0; j < limit; j++ {
+				if values[i][j] != expectValues[i][j] || scores[indexes[i][j]*batch+i] != values[i][j] {
+					t.Fatal("Wrong batch top k, workers:", workers, "target:", i, "at:", j)
+				}
+			}
+		}
+	}
+
+	indexes, values := BatchTopKFloat32(scores, batch, height, height, 0.5)
+	for i := 0; i < batch; i++ {
+		var expect int
+		for j := 0; j < height; j++ {
+			if scores[j*batch+i] >= 0.5 {
+				expect++
+			}
+		}
+		if len(indexes[i]) != expect || (expect > 0 && values[i][expect-1] < 0.5) {
+			t.Fatal("Wrong batch top k with threshold, target:", i, "got:", len(indexes[i]), "expect:", expect)
+		}
+	}
+}
+
+func TestTopKFeatureResult(t *testing.T) {
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	var results []FeatureSearchResult
+	for _, score := range randomScores(r, 100) {
+		results = append(results, FeatureSearchResult{Score: FeatureScore(score), ID: FeatureID(GetRandomString(12))})
+	}
+	ret := TopKFeatureResult(results, 10)
+	_, expect := MaxNFeatureResult(results, 10)
+	if len(ret) != 10 {
+		t.Fatal("Wrong top k number, got:", len(ret))
+	}
+	for i := range ret {
+		if ret[i].ID != expect[i].ID {
+			t.Fatal("Wrong top k result at:", i, "got:", ret[i], "expect:", expect[i])
+		}
+	}
+}
+
+var (
+	benchmarkScores = randomScores(rand.New(rand.NewSource(1)), 1000000)
+	benchmarkBatch  = 10
+)
+
+func BenchmarkMaxNFloat32(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		MaxNFloat32(benchmarkScores, 1)
+	}
+}
+
+func BenchmarkTopKFloat32(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		TopKFloat32(benchmarkScores, 1, float32(math.Inf(-1)))
+	}
+}
+
+func BenchmarkBatchMaxNFloat32(b *testing.B) {
+	height := len(benchmarkScores) / benchmarkBatch
+	for i := 0; i < b.N; i++ {
+		BatchMaxNFloat32(benchmarkScores, benchmarkBatch, height, 10)
+	}
+}
+
+func BenchmarkBatchTopKFloat32(b *testing.B) {
+	height := len(benchmarkScores) / benchmarkBatch
+	for i := 0; i < b.N; i++ {
+		BatchTopKFloat32(benchmarkScores, benchmarkBatch, height, 10, float32(math.Inf(-1)))
+	}
+}
+
+func BenchmarkParallelBatchTopKFloat32(b *testing.B) {
+	height := len(benchmarkScores) / benchmarkBatch
+	for i := 0; i < b.N; i++ {
+		ParallelBatchTopKFloat32(benchmarkScores, benchmarkBatch, height, 10, float32(math.Inf(-1)), benchmarkBatch)
+	}
+}
+
+func BenchmarkMaxNFeatureResult(b *testing.B) {
+	results := make([]FeatureSearchResult, 10000)
+	for i := range results {
+		results[i].Score = FeatureScore(benchmarkScores[i])
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		MaxNFeatureResult(results, 10)
+	}
+}
+
+func BenchmarkTopKFeatureResult(b *testing.B) {
+	results := make([]FeatureSearchResult, 10000)
+	for i := range results {
+		results[i].Score = FeatureScore(benchmarkScores[i])
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		TopKFeatureResult(results, 10)
+	}
+}
+
+func TestKernelSelectTopK(t *testing.T) {
+	const (
+		batch  = 3
+		height = 200
+		limit  = 4
+	)
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	products := randomScores(r, batch*height)
+	transform := ScoreTransform{
+		Scale:     randomScores(r, height),
+		Bias:      randomScores(r, height),
+		QueryBias: randomScores(r, batch),
+	}
+	for j := 0; j < height; j += 7 {
+		transform.Bias[j] = float32(math.Inf(-1))
+	}
+
+	device := newTestDevice()
+	kernel, err := device.NewKernel()
+	if err != nil {
+		t.Fatal("Fail to create kernel, due to:", err)
+	}
+	output, err := device.NewBuffer(batch * height * 4)
+	if err != nil {
+		t.Fatal("Fail to create buffer, due to:", err)
+	}
+	value, _ := TFeatureValue(products)
+	if err = output.Write(value); err != nil {
+		t.Fatal("Fail to write buffer, due to:", err)
+	}
+	indexes, values, err := kernel.SelectTopK(output, batch, height, limit, -0.5, transform)
+	if err != nil {
+		t.Fatal("Fail to select top k, due to:", err)
+	}
+
+	// reference on host
+	scores := append([]float32{}, products...)
+	transform.Apply(scores, batch, height)
+	expectIndexes, expectValues := BatchTopKFloat32(scores, batch, height, limit, -0.5)
+	for i := 0; i < batch; i++ {
+		if len(indexes[i]) != len(expectIndexes[i]) {
+			t.Fatal("Wrong top k number of target", i, "got:", len(indexes[i]), "expect:", len(expectIndexes[i]))
+		}
+		for j := range indexes[i] {
+			if indexes[i][j] != expectIndexes[i][j] || math.Abs(float64(values[i][j]-expectValues[i][j])) > 1e-5 {
+				t.Fatal("Wrong top k of target", i, "at:", j, "got:", indexes[i][j], values[i][j],
+					"expect:", expectIndexes[i][j], expectValues[i][j])
+			}
+			if indexes[i][j]%7 == 0 {
+				t.Fatal("Excluded feature is selected:", indexes[i][j])
+			}
+		}
+	}
+}
@@ -1,5 +1,3 @@
-// +build cublas
-
 package goFeature
 
 import (
@@ -73,6 +71,18 @@ func TFeatureValue(value interface{}) (FeatureValue, error) {
 	return nil, ErrInvalidBufferData
 }
 
+// TFloat32Value : view little endian feature value as float32 vector, no copy
+func TFloat32Value(value FeatureValue) ([]float32, error) {
+	if len(value)%4 != 0 {
+		return nil, ErrInvalidBufferData
+	}
+	if len(value) == 0 {
+		return nil, nil
+	}
+	n := len(value) / 4
+	return (*[1 << 28]float32)(unsafe.Pointer(&value[0]))[:n:n], nil
+}
+
 func MaxNFloat32(vector []float32, limit int) ([]int, []float32) {
 	type _result struct {
 		Value float32
@@ -92,6 +102,20 @@ func MaxNFloat32(vector []float32, limit int) ([]int, []float32) {
 	return index, max
 }
 
+// BatchMaxNFloat32 : top N of each target in scores stored as [height][batch]
+func BatchMaxNFloat32(scores []float32, batch, height, limit int) (indexes [][]int, values [][]float32) {
+	indexes = make([][]int, batch)
+	values = make([][]float32, batch)
+	vec := make([]float32, height)
+	for i := 0; i < batch; i++ {
+		for j := 0; j < height; j++ {
+			vec[j] = scores[j*batch+i]
+		}
+		indexes[i], values[i] = MaxNFloat32(vec, limit)
+	}
+	return
+}
+
 func MaxNFeatureResult(vector []FeatureSearchResult, limit int) ([]int, []FeatureSearchResult) {
 	type _result struct {
 		Value FeatureSearchResult
@@ -111,6 +135,27 @@ func MaxNFeatureResult(vector []FeatureSearchResult, limit int) ([]int, []Featur
 	return index, max
 }
 
+// CopyAttributes : validate and copy attributes, int values are stored as int64
+func CopyAttributes(attrs Attributes) (ret Attributes, err error) {
+	if attrs == nil {
+		return
+	}
+	ret = make(Attributes, len(attrs))
+	for key, value := range attrs {
+		switch v := value.(type) {
+		case string, int64, time.Time:
+			ret[key] = v
+		case int:
+			ret[key] = int64(v)
+		case int32:
+			ret[key] = int64(v)
+		default:
+			return nil, ErrInvalidAttribute
+		}
+	}
+	return
+}
+
 func GetRandomString(length int) string {
 	str := "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ_-"
 	bytes := []byte(str)
@@ -122,6 +167,42 @@ func GetRandomString(length int) string {
 	return string(result)
 }
 
+// BatchNoramlizeFloat32 : normalize N feature(s)
+func BatchNoramlizeFloat32(features ...[]float32) (ret [][]float32) {
+	for _, feature := range features {
+		ret = append(ret, NoramlizeFloat32(feature))
+	}
+	return
+}
+
+// NoramlizeFeatureValues : normalize N float32 feature value(s), the origin values are not changed
+func NoramlizeFeatureValues(values ...FeatureValue) (ret []FeatureValue, err error) {
+	features := make([][]float32, len(values))
+	for i, value := range values {
+		if features[i], err = TFloat32Value(value); err != nil {
+			return
+		}
+	}
+	for _, feature := range BatchNoramlizeFloat32(features...) {
+		var value FeatureValue
+		if len(feature) > 0 {
+			if value, err = TFeatureValue(feature); err != nil {
+				return
+			}
+		}
+		ret = append(ret, value)
+	}
+	return
+}
+
+// SquareNormFloat32 : squared L2 norm of feature
+func SquareNormFloat32(feature []float32) (norm float32) {
+	for _, value := range feature {
+		norm += value * value
+	}
+	return
+}
+
 func NoramlizeFloat32(feature []float32) (ret []float32) {
 	var mode float32
 	for _, value := range feature {
@@ -0,0 +1,398 @@
+package goFeature
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// write-ahead log format, little endian
+//
+//	record:  length uint32 | crc32 uint32 of payload | payload
+//	payload: seq uint64 | op byte | set name | body
+//	body:    add, update: feature number uint32 | id | value bytes | attributes, for each feature
+//	         delete: id number uint32 | id...
+//	         new set: dims, precision, batch, metric, min blocks, max blocks uint32
+//	         destroy set: empty
+//
+// records are appended after the mutation is validated and before it is applied,
+// the mutation is not applied if the record fails to append. records are replayed
+// in order by Add as Upsert, so replaying on top of a snapshot taken at any time is safe
+const (
+	walOpAdd byte = iota + 1
+	walOpDelete
+	walOpUpdate
+	walOpNewSet
+	walOpDestroySet
+
+	walHeaderSize = 8
+)
+
+// SyncPolicy : when the write-ahead log is flushed to disk
+type SyncPolicy int
+
+const (
+	// fsync after every record
+	SyncAlways SyncPolicy = iota
+	// fsync periodically in background, by WALOptions.Interval
+	SyncInterval
+	// never fsync, leave it to the os
+	SyncNever
+)
+
+// WALOptions : options of write-ahead log
+type WALOptions struct {
+	// fsync policy
+	Sync SyncPolicy
+	// fsync interval for SyncInterval, 1 second if zero
+	Interval time.Duration
+}
+
+// WAL : append-only write-ahead log of set mutations
+type WAL struct {
+	Path    string
+	Options WALOptions
+	Mutex   sync.Mutex
+
+	file  *os.File
+	seq   uint64
+	dirty bool
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// OpenWAL :
+//	open or create the write-ahead log, broken records at the tail are truncated
+func OpenWAL(path string, opts WALOptions) (wal *WAL, err error) {
+	wal = &WAL{Path: path, Options: opts}
+	if wal.file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		return nil, err
+	}
+	var offset int64
+	err = wal.scan(func(seq uint64, payload []byte, end int64) error {
+		wal.seq, offset = seq, end
+		return nil
+	})
+	if err == nil {
+		err = wal.file.Truncate(offset)
+	}
+	if err == nil {
+		_, err = wal.file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		wal.file.Close()
+		return nil, err
+	}
+	if opts.Sync == SyncInterval {
+		if wal.Options.Interval <= 0 {
+			wal.Options.Interval = time.Second
+		}
+		wal.stop, wal.done = make(chan struct{}), make(chan struct{})
+		go wal.syncLoop()
+	}
+	return
+}
+
+// Seq :
+//	sequence number of the last record
+func (w *WAL) Seq() uint64 {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	return w.seq
+}
+
+// Close :
+//	sync and close the log
+func (w *WAL) Close() (err error) {
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+	}
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	if err = w.file.Sync(); err != nil {
+		return
+	}
+	return w.file.Close()
+}
+
+// Replay :
+//	apply all the records in the log to cache, in order
+//	it should be called before the log is attached to the cache by Cache.SetWAL
+func (w *WAL) Replay(cache Cache) error {
+	return w.scan(func(seq uint64, payload []byte, end int64) error {
+		return replayRecord(cache, payload)
+	})
+}
+
+// Truncate :
+//	drop the records whose sequence number <= seq, called after a successful snapshot
+func (w *WAL) Truncate(seq uint64) (err error) {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+
+	var remain bytes.Buffer
+	err = w.scan(func(s uint64, payload []byte, end int64) error {
+		if s > seq {
+			writeRecord(&remain, payload)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	tmp := w.Path + ".tmp"
+	if err = writeFileSync(tmp, remain.Bytes()); err != nil {
+		return
+	}
+	if err = os.Rename(tmp, w.Path); err != nil {
+		return
+	}
+	w.file.Close()
+	if w.file, err = os.OpenFile(w.Path, os.O_RDWR, 0644); err != nil {
+		return
+	}
+	_, err = w.file.Seek(0, io.SeekEnd)
+	return
+}
+
+func (w *WAL) logAdd(name string, features ...Feature) error {
+	return w.append(walOpAdd, name, func(writer *snapshotWriter) { writeFeatures(writer, features) })
+}
+
+func (w *WAL) logUpdate(name string, features ...Feature) error {
+	return w.append(walOpUpdate, name, func(writer *snapshotWriter) { writeFeatures(writer, features) })
+}
+
+func (w *WAL) logDelete(name string, ids ...FeatureID) error {
+	return w.append(walOpDelete, name, func(writer *snapshotWriter) {
+		writer.write(uint32(len(ids)))
+		for _, id := range ids {
+			writer.writeString(string(id))
+		}
+	})
+}
+
+func (w *WAL) logNewSet(name string, dims, precision, batch int, metric Metric, quota SetQuota) error {
+	return w.append(walOpNewSet, name, func(writer *snapshotWriter) {
+		writer.write([]uint32{uint32(dims), uint32(precision), uint32(batch), uint32(metric)})
+		writer.write([]uint32{uint32(quota.MinBlocks), uint32(quota.MaxBlocks)})
+	})
+}
+
+func (w *WAL) logDestroySet(name string) error {
+	return w.append(walOpDestroySet, name, func(writer *snapshotWriter) {})
+}
+
+// append :
+//	append one record, and fsync it by policy
+func (w *WAL) append(op byte, name string, body func(*snapshotWriter)) (err error) {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+
+	var payload bytes.Buffer
+	writer := &snapshotWriter{w: &payload}
+	writer.write(w.seq + 1)
+	writer.write(op)
+	writer.writeString(name)
+	body(writer)
+	if writer.err != nil {
+		return writer.err
+	}
+	if err = writeRecord(w.file, payload.Bytes()); err != nil {
+		return
+	}
+	w.seq++
+	switch w.Options.Sync {
+	case SyncAlways:
+		err = w.file.Sync()
+	case SyncInterval:
+		w.dirty = true
+	}
+	return
+}
+
+func (w *WAL) syncLoop() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.Options.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Mutex.Lock()
+			if w.dirty {
+				w.file.Sync()
+				w.dirty = false
+			}
+			w.Mutex.Unlock()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// scan :
+//	walk through valid records from the beginning, stop at the first broken record
+//	end is the offset after the record
+func (w *WAL) scan(fn func(seq uint64, payload []byte, end int64) error) (err error) {
+	file, err := os.Open(w.Path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return
+	}
+	reader := bufio.NewReader(file)
+	var offset int64
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err = io.ReadFull(reader, header); err != nil {
+			return nil
+		}
+		length := binary.LittleEndian.Uint32(header[:4])
+		checksum := binary.LittleEndian.Uint32(header[4:])
+		// a corrupt length beyond the file is a broken tail, checked before allocation
+		if offset+walHeaderSize+int64(length) > info.Size() {
+			return nil
+		}
+		payload := make([]byte, length)
+		if _, err = io.ReadFull(reader, payload); err != nil {
+			return nil
+		}
+		if crc32.ChecksumIEEE(payload) != checksum || length < 8 {
+			return nil
+		}
+		offset += walHeaderSize + int64(length)
+		if err = fn(binary.LittleEndian.Uint64(payload[:8]), payload, offset); err != nil {
+			return
+		}
+	}
+}
+
+func writeRecord(w io.Writer, payload []byte) (err error) {
+	header := make([]byte, walHeaderSize)
+	binary.LittleEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload))
+	if _, err = w.Write(header); err != nil {
+		return
+	}
+	_, err = w.Write(payload)
+	return
+}
+
+func writeFileSync(path string, data []byte) (err error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	return
+}
+
+func writeFeatures(writer *snapshotWriter, features []Feature) {
+	writer.write(uint32(len(features)))
+	for _, feature := range features {
+		writer.writeString(string(feature.ID))
+		writer.writeBytes(feature.Value)
+		writer.writeAttributes(feature.Attributes)
+	}
+}
+
+func readFeatures(reader *snapshotReader) (features []Feature) {
+	num := reader.readUint32()
+	for i := 0; i < num && reader.err == nil; i++ {
+		var feature Feature
+		feature.ID = FeatureID(reader.readString())
+		feature.Value = reader.readBytes(maxSnapshotString)
+		feature.Attributes = reader.readAttributes()
+		features = append(features, feature)
+	}
+	return
+}
+
+// replayRecord :
+//	apply one record to cache, the operations are idempotent
+func replayRecord(cache Cache, payload []byte) (err error) {
+	reader := &snapshotReader{r: bytes.NewReader(payload[8:])}
+	var op byte
+	reader.read(&op)
+	name := reader.readString()
+	if reader.err != nil {
+		return ErrInvalidWAL
+	}
+
+	switch op {
+	case walOpNewSet:
+		dims, precision, batch, metric := reader.readUint32(), reader.readUint32(), reader.readUint32(), reader.readUint32()
+		quota := SetQuota{MinBlocks: reader.readUint32(), MaxBlocks: reader.readUint32()}
+		if reader.err != nil {
+			return ErrInvalidWAL
+		}
+		if err = cache.NewSet(name, dims, precision, batch, Metric(metric), quota); err == ErrFeatureSetExist {
+			err = nil
+		}
+		return
+	case walOpDestroySet:
+		if err = cache.DestroySet(name); err == ErrFeatureSetNotFound {
+			err = nil
+		}
+		return
+	}
+
+	set, err := cache.GetSet(name)
+	if err != nil {
+		return
+	}
+	switch op {
+	case walOpAdd, walOpUpdate:
+		features := readFeatures(reader)
+		if reader.err != nil {
+			return ErrInvalidWAL
+		}
+		err = replayFeatures(set.(*FeatureSet), op, features...)
+	case walOpDelete:
+		num := reader.readUint32()
+		var ids []FeatureID
+		for i := 0; i < num && reader.err == nil; i++ {
+			ids = append(ids, FeatureID(reader.readString()))
+		}
+		if reader.err != nil {
+			return ErrInvalidWAL
+		}
+		_, err = set.Delete(ids...)
+	default:
+		err = ErrInvalidWAL
+	}
+	return
+}
+
+// replayFeatures :
+//	logged values are prepared already, they are applied as they are instead of normalized again
+func replayFeatures(set *FeatureSet, op byte, features ...Feature) (err error) {
+	set.Mutex.Lock()
+	defer set.Mutex.Unlock()
+
+	for _, feature := range features {
+		if len(feature.Value) != set.Dimension*set.Precision {
+			return ErrInvalidWAL
+		}
+	}
+	if op == walOpAdd {
+		_, _, err = set.upsert(features...)
+	} else {
+		_, err = set.update(features...)
+	}
+	return
+}
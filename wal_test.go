@@ -0,0 +1,314 @@
+package goFeature
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestWALReplay(t *testing.T) {
+	const (
+		dims      = 8
+		blockSize = 16 * dims * 4
+	)
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal("Fail to create temp dir, due to:", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.wal")
+
+	wal, err := OpenWAL(path, WALOptions{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal("Fail to open wal, due to:", err)
+	}
+	src, err := NewCache(newTestDevice(), 4, blockSize)
+	if err != nil {
+		t.Fatal("Fail to init cache, due to:", err)
+	}
+	src.SetWAL(wal)
+	if err = src.NewSet("wal", dims, 4, 2, MetricDefault, SetQuota{}); err != nil {
+		t.Fatal("Fail to init feature set, due to:", err)
+	}
+	s, err := src.GetSet("wal")
+	if err != nil {
+		t.Fatal("Fail to get feature set, due to:", err)
+	}
+
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	features := randomFeatures(r, 20, dims)
+	if err = s.Add(features[:10]...); err != nil {
+		t.Fatal("Fail to fill feature set, due to:", err)
+	}
+	var snapshot bytes.Buffer
+	if err = src.Snapshot(&snapshot); err != nil {
+		t.Fatal("Fail to snapshot cache, due to:", err)
+	}
+
+	// mutations after snapshot
+	if err = s.Add(features[10:]...); err != nil {
+		t.Fatal("Fail to fill feature set, due to:", err)
+	}
+	if _, err = s.Delete(features[0].ID, features[15].ID); err != nil {
+		t.Fatal("Fail to delete features, due to:", err)
+	}
+	update := Feature{ID: features[1].ID, Value: features[19].Value}
+	if _, err = s.Update(update); err != nil {
+		t.Fatal("Fail to update feature, due to:", err)
+	}
+	wal.Close()
+
+	// broken tail of a crash, the header claims a record of 2GB
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte{0xff, 0xff, 0xff, 0x7f, 1, 2, 3, 4, 5})
+	file.Close()
+
+	dst, err := RestoreCache(bytes.NewReader(snapshot.Bytes()), newTestDevice(), 4, blockSize)
+	if err != nil {
+		t.Fatal("Fail to restore cache, due to:", err)
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if wal, err = OpenWAL(path, WALOptions{Sync: SyncInterval}); err != nil {
+		t.Fatal("Fail to reopen wal, due to:", err)
+	}
+	defer wal.Close()
+	if runtime.ReadMemStats(&after); after.TotalAlloc-before.TotalAlloc > 1<<20 {
+		t.Fatal("Broken tail should not be allocated, allocated:", after.TotalAlloc-before.TotalAlloc)
+	}
+	if seq := wal.Seq(); seq != 5 {
+		t.Fatal("Fail to recover sequence number, got:", seq)
+	}
+	if err = wal.Replay(dst); err != nil {
+		t.Fatal("Fail to replay wal, due to:", err)
+	}
+
+	restored, err := dst.GetSet("wal")
+	if err != nil {
+		t.Fatal("Fail to get feature set, due to:", err)
+	}
+	ret, err := restored.Read(features[0].ID, features[1].ID, features[15].ID, features[18].ID)
+	notFound, ok := err.(*FeatureNotFoundError)
+	if !ok || len(notFound.IDs) != 2 || len(ret) != 2 {
+		t.Fatal("Fail to replay delete, ret:", ret, "err:", err)
+	}
+	if string(ret[0].Value) != string(features[19].Value) || string(ret[1].Value) != string(features[18].Value) {
+		t.Fatal("Fail to replay add and update, ret:", ret)
+	}
+}
+
+func TestWALReplayCosine(t *testing.T) {
+	// normalizing again changes the bytes of some vectors at 512 dims, but rarely at small dims
+	size := 16 * dims * premision
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal("Fail to create temp dir, due to:", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.wal")
+
+	wal, err := OpenWAL(path, WALOptions{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal("Fail to open wal, due to:", err)
+	}
+	src, err := NewCache(newTestDevice(), 4, size)
+	if err != nil {
+		t.Fatal("Fail to init cache, due to:", err)
+	}
+	src.SetWAL(wal)
+	if err = src.NewSet("wal_cosine", dims, premision, 2, MetricCosine, SetQuota{}); err != nil {
+		t.Fatal("Fail to init feature set, due to:", err)
+	}
+	s, err := src.GetSet("wal_cosine")
+	if err != nil {
+		t.Fatal("Fail to get feature set, due to:", err)
+	}
+	r := rand.New(rand.NewSource(time.Now().Unix()))
+	features := randomFeatures(r, 40, dims)
+	if err = s.Add(features[:30]...); err != nil {
+		t.Fatal("Fail to fill feature set, due to:", err)
+	}
+	if _, err = s.Update(Feature{ID: features[0].ID, Value: features[30].Value}); err != nil {
+		t.Fatal("Fail to update feature, due to:", err)
+	}
+	if _, _, err = s.Upsert(features[31:]...); err != nil {
+		t.Fatal("Fail to upsert features, due to:", err)
+	}
+	wal.Close()
+
+	ids := make([]FeatureID, 0, len(features))
+	for _, feature := range features[:30] {
+		ids = append(ids, feature.ID)
+	}
+	for _, feature := range features[31:] {
+		ids = append(ids, feature.ID)
+	}
+	stored, err := s.Read(ids...)
+	if err != nil {
+		t.Fatal("Fail to read features, due to:", err)
+	}
+
+	dst, err := NewCache(newTestDevice(), 4, size)
+	if err != nil {
+		t.Fatal("Fail to init cache, due to:", err)
+	}
+	if wal, err = OpenWAL(path, WALOptions{Sync: SyncAlways}); err != nil {
+		t.Fatal("Fail to reopen wal, due to:", err)
+	}
+	defer wal.Close()
+	if err = wal.Replay(dst); err != nil {
+		t.Fatal("Fail to replay wal, due to:", err)
+	}
+	replayed, err := dst.GetSet("wal_cosine")
+	if err != nil {
+		t.Fatal("Fail to get replayed set, due to:", err)
+	}
+	ret, err := replayed.Read(ids...)
+	if err != nil || len(ret) != len(stored) {
+		t.Fatal("Fail to read replayed features, due to:", err)
+	}
+	// the logged values are normalized already, they should be kept as they are
+	for i := range stored {
+		if !bytes.Equal(ret[i].Value, stored[i].Value) {
+			t.Fatalf("Value of feature %s is changed by replay", stored[i].ID)
+		}
+	}
+}
+
+func TestConcurrentSetWAL(t *testing.T) {
+	const dims = 8
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal("Fail to create temp dir, due to:", err)
+	}
+	defer os.RemoveAll(dir)
+	wal, err := OpenWAL(filepath.Join(dir, "cache.wal"), WALOptions{Sync: SyncNever})
+	if err != nil {
+		t.Fatal("Fail to open wal, due to:", err)
+	}
+	defer wal.Close()
+
+	c, err := NewCache(newTestDevice(), 4, 16*dims*4)
+	if err != nil {
+		t.Fatal("Fail to init cache, due to:", err)
+	}
+	if err = c.NewSet("concurrent_wal", dims, 4, 2, MetricDefault, SetQuota{}); err != nil {
+		t.Fatal("Fail to init feature set, due to:", err)
+	}
+	s, err := c.GetSet("concurrent_wal")
+	if err != nil {
+		t.Fatal("Fail to get feature set, due to:", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 200; i++ {
+			features := randomFeatures(r, 1, dims)
+			if err := s.Add(features...); err != nil {
+				t.Error("Fail to add features, due to:", err)
+				return
+			}
+			if _, err := s.Delete(features[0].ID); err != nil {
+				t.Error("Fail to delete features, due to:", err)
+				return
+			}
+			s.Compact()
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				c.SetWAL(wal)
+				c.SetWAL(nil)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Add and SetWAL are deadlocked")
+	}
+}
+
+func TestWALAppendFailure(t *testing.T) {
+	const (
+		dims      = 8
+		blockSize = 16 * dims * 4
+	)
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal("Fail to create temp dir, due to:", err)
+	}
+	defer os.RemoveAll(dir)
+	wal, err := OpenWAL(filepath.Join(dir, "cache.wal"), WALOptions{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal("Fail to open wal, due to:", err)
+	}
+
+	c, err := NewCache(newTestDevice(), 4, blockSize)
+	if err != nil {
+		t.Fatal("Fail to init cache, due to:", err)
+	}
+	c.SetWAL(wal)
+	if err = c.NewSet("wal_failure", dims, 4, 2, MetricDefault, SetQuota{}); err != nil {
+		t.Fatal("Fail to init feature set, due to:", err)
+	}
+	s, err := c.GetSet("wal_failure")
+	if err != nil {
+		t.Fatal("Fail to get feature set, due to:", err)
+	}
+	r := rand.New(rand.NewSource(1))
+	features := randomFeatures(r, 16, dims)
+	if err = s.Add(features...); err != nil {
+		t.Fatal("Fail to add features, due to:", err)
+	}
+	seq := wal.Seq()
+
+	// records can not be appended once the log is closed
+	wal.Close()
+	if err = s.Add(randomFeatures(r, 4, dims)...); err == nil {
+		t.Fatal("Add should fail if the record fails to append")
+	}
+	if _, err = s.Delete(features[0].ID); err == nil {
+		t.Fatal("Delete should fail if the record fails to append")
+	}
+	updated := Feature{ID: features[1].ID, Value: randomFeatures(r, 1, dims)[0].Value}
+	if _, err = s.Update(updated); err == nil {
+		t.Fatal("Update should fail if the record fails to append")
+	}
+	if err = c.NewSet("wal_failure_new", dims, 4, 2, MetricDefault, SetQuota{}); err == nil {
+		t.Fatal("NewSet should fail if the record fails to append")
+	}
+	if err = c.DestroySet("wal_failure"); err == nil {
+		t.Fatal("DestroySet should fail if the record fails to append")
+	}
+	if names := c.ListSets(); len(names) != 1 || names[0] != "wal_failure" {
+		t.Fatal("Sets should be unchanged, got:", names)
+	}
+
+	if wal.Seq() != seq {
+		t.Fatalf("Records should not be counted on failure, expect seq %d, got %d", seq, wal.Seq())
+	}
+	if stats := s.Stats(); stats.Features != len(features) || stats.Blocks != 1 {
+		t.Fatalf("Set should be unchanged, expect %d features in 1 block, got %d in %d", len(features), stats.Features, stats.Blocks)
+	}
+	read, err := s.Read(features[0].ID, features[1].ID)
+	if err != nil || len(read) != 2 {
+		t.Fatal("Features should not be deleted, due to:", err)
+	}
+	for i, feature := range read {
+		if !bytes.Equal(feature.Value, features[i].Value) {
+			t.Fatalf("Feature %s should not be updated", feature.ID)
+		}
+	}
+}